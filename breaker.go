@@ -0,0 +1,122 @@
+package introspect
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+)
+
+// breaker is a circuit breaker around the introspection endpoint. It opens
+// after threshold consecutive failures within window, rejects calls for
+// cooldown and then lets a single probe through to test recovery.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	failures int
+	first    time.Time
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, window, cooldown time.Duration, now func() time.Time) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, window: window, cooldown: cooldown, now: now}
+}
+
+// allow reports whether a call may be made. A nil breaker always allows.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+// success closes the circuit.
+func (b *breaker) success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.open = false
+	b.probing = false
+	b.failures = 0
+}
+
+// failure records a failed call, opening the circuit once the threshold is
+// reached or when a probe fails.
+func (b *breaker) failure() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if b.open {
+		b.probing = false
+		b.openedAt = now
+		return
+	}
+
+	if b.failures == 0 || (b.window > 0 && now.Sub(b.first) > b.window) {
+		b.failures = 0
+		b.first = now
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open = true
+		b.openedAt = now
+	}
+}
+
+// record records the outcome of a call that returned err. Verdicts are
+// successes, cancelled and rejected calls have no outcome.
+func (b *breaker) record(err error) {
+	switch err {
+	case nil, introspection.ErrUnauthorized, introspection.ErrForbidden:
+		b.success()
+	case context.Canceled, ErrSaturated:
+		b.release()
+	default:
+		b.failure()
+	}
+}
+
+// release gives up a call without an outcome, e.g. when the request was
+// cancelled, so another probe can be made.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
@@ -0,0 +1,134 @@
+package introspect
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestBreakerCountsSharedCallsOnce(t *testing.T) {
+	const requests = 5
+
+	release := make(chan struct{})
+	e := newTestEndpoint(t, func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	m := newTestMiddleware(t, Config{Config: e.config(), CircuitBreakerThreshold: 2})
+	app := newTestApp(m.Handler())
+
+	var wg sync.WaitGroup
+	for n := 0; n < requests; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := app.Test(newRequest("/", "token"), -1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// Every request joins the call of the first one before it fails.
+	for m.Stats().Introspections < requests {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if e.calls() != 1 {
+		t.Fatalf("endpoint called %d times, want 1", e.calls())
+	}
+
+	// A single failure is below the threshold, so the circuit is closed.
+	if got := send(t, app, newRequest("/", "other")); got != fiber.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", got, fiber.StatusInternalServerError)
+	}
+	if e.calls() != 2 {
+		t.Errorf("endpoint called %d times, want 2", e.calls())
+	}
+}
+
+func TestBreakerCooldown(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newBreaker(2, 0, time.Minute, func() time.Time { return now })
+
+	b.failure()
+	if !b.allow() {
+		t.Fatal("circuit opened below the threshold")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatal("circuit closed at the threshold")
+	}
+
+	now = now.Add(59 * time.Second)
+	if b.allow() {
+		t.Fatal("probe let through before the cooldown")
+	}
+	now = now.Add(time.Second)
+	if !b.allow() {
+		t.Fatal("no probe let through after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("a second probe was let through")
+	}
+
+	b.success()
+	if !b.allow() {
+		t.Fatal("circuit still open after a successful probe")
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newBreaker(2, time.Minute, time.Minute, func() time.Time { return now })
+
+	b.failure()
+	now = now.Add(2 * time.Minute)
+	b.failure()
+	if !b.allow() {
+		t.Fatal("failures outside the window opened the circuit")
+	}
+}
+
+func TestBreakerOpenServesCache(t *testing.T) {
+	var failing atomic.Bool
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		respondJSON(active(nil))(w, r)
+	})
+	app := newTestApp(New(Config{
+		Config:                  e.config(),
+		Cache:                   NewMemoryCache(0),
+		CircuitBreakerThreshold: 1,
+		OnCircuitOpen: func(c *fiber.Ctx) error {
+			return c.SendStatus(fiber.StatusServiceUnavailable)
+		},
+	}))
+
+	if got := send(t, app, newRequest("/", "cached")); got != fiber.StatusOK {
+		t.Fatalf("status = %d, want %d", got, fiber.StatusOK)
+	}
+	failing.Store(true)
+	if got := send(t, app, newRequest("/", "failing")); got != fiber.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", got, fiber.StatusInternalServerError)
+	}
+
+	if got := send(t, app, newRequest("/", "cached")); got != fiber.StatusOK {
+		t.Errorf("cached token: status = %d, want %d", got, fiber.StatusOK)
+	}
+	if got := send(t, app, newRequest("/", "uncached")); got != fiber.StatusServiceUnavailable {
+		t.Errorf("uncached token: status = %d, want %d", got, fiber.StatusServiceUnavailable)
+	}
+	if e.calls() != 2 {
+		t.Errorf("endpoint called %d times with the circuit open, want 2", e.calls())
+	}
+}
@@ -0,0 +1,241 @@
+package introspect
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+)
+
+// ErrCacheMiss is returned by Cache.Get when no value is stored for a key.
+// Caches may wrap it.
+var ErrCacheMiss = errors.New("introspect: cache miss")
+
+// Cache stores introspection results serialized as JSON, so that any key
+// value store can back it. Keys are hashes of the tokens, never the tokens
+// themselves. Inactive results are stored for negative caching.
+//
+// Results are cached, not authorization decisions: Scopes, audience, issuer
+// and claim checks run on every request, including the Audience and Issuers
+// of the introspection.Config, so middleware with different requirements can
+// share a Cache.
+//
+// Operations receive the context of the request, bounded by
+// Config.CacheTimeout. Errors other than ErrCacheMiss are logged and the
+// token is introspected as if it was not cached.
+type Cache interface {
+	// Get returns the value stored for key, or ErrCacheMiss if there is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set stores value for key for at most ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Delete removes the value stored for key. Deleting a missing key is
+	// not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// cacheKey hashes token with SHA-256, keyed by salt when one is given.
+func cacheKey(token, salt string) string {
+	var h hash.Hash
+	if salt != "" {
+		h = hmac.New(sha256.New, []byte(salt))
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(token))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// purger is implemented by caches able to drop expired entries.
+type purger interface {
+	Purge()
+}
+
+// clearer is implemented by caches able to drop every entry.
+type clearer interface {
+	Clear(ctx context.Context) error
+}
+
+// prefixClearer is implemented by caches able to drop the entries whose key
+// starts with a prefix, so that InvalidateAll only clears its CacheNamespace.
+type prefixClearer interface {
+	ClearPrefix(ctx context.Context, prefix string) error
+}
+
+// purge calls p.Purge every interval until ctx is done.
+func purge(ctx context.Context, p purger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.Purge()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// MemoryCache is an in-memory LRU Cache safe for concurrent use.
+type MemoryCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// NewMemoryCache creates a MemoryCache holding at most size entries.
+// A size less than or equal to 0 means no limit.
+func NewMemoryCache(size int) *MemoryCache {
+	return &MemoryCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get implements Cache.
+func (m *MemoryCache) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	entry := el.Value.(*memoryEntry)
+	if time.Now().After(entry.expires) {
+		m.remove(el)
+		return nil, ErrCacheMiss
+	}
+
+	m.order.MoveToFront(el)
+	return entry.value, nil
+}
+
+// Set implements Cache.
+func (m *MemoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	if el, ok := m.entries[key]; ok {
+		entry := el.Value.(*memoryEntry)
+		entry.value = value
+		entry.expires = expires
+		m.order.MoveToFront(el)
+		return nil
+	}
+
+	m.entries[key] = m.order.PushFront(&memoryEntry{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+
+	if m.size > 0 && m.order.Len() > m.size {
+		m.remove(m.order.Back())
+	}
+	return nil
+}
+
+// Delete implements Cache.
+func (m *MemoryCache) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+	return nil
+}
+
+// Clear removes every entry.
+func (m *MemoryCache) Clear(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = make(map[string]*list.Element)
+	m.order.Init()
+	return nil
+}
+
+// ClearPrefix removes every entry whose key starts with prefix.
+func (m *MemoryCache) ClearPrefix(_ context.Context, prefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, el := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			m.remove(el)
+		}
+	}
+	return nil
+}
+
+// Purge removes expired entries.
+func (m *MemoryCache) Purge() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for el := m.order.Back(); el != nil; {
+		prev := el.Prev()
+		if now.After(el.Value.(*memoryEntry).expires) {
+			m.remove(el)
+		}
+		el = prev
+	}
+}
+
+func (m *MemoryCache) remove(el *list.Element) {
+	m.order.Remove(el)
+	delete(m.entries, el.Value.(*memoryEntry).key)
+}
+
+// cacheTTL caps max at the remaining lifetime of result as of now.
+// It returns 0 when result has already expired.
+func cacheTTL(result *introspection.Result, max time.Duration, now time.Time) time.Duration {
+	if result.Expires == 0 {
+		return max
+	}
+
+	remaining := time.Unix(result.Expires, 0).Sub(now)
+	if remaining <= 0 {
+		return 0
+	}
+	if remaining < max {
+		return remaining
+	}
+	return max
+}
+
+// isInactive reports whether an introspection outcome is a definitive
+// verdict that the token is not valid.
+func isInactive(result *introspection.Result, err error) bool {
+	if err != nil {
+		return err == introspection.ErrUnauthorized
+	}
+	return result == nil || !result.Active
+}
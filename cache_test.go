@@ -0,0 +1,149 @@
+package introspect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMemoryCacheClearPrefix(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryCache(0)
+	for _, key := range []string{"orders:1", "orders:2", "users:1", "1"} {
+		if err := cache.Set(ctx, key, []byte(key), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cache.ClearPrefix(ctx, "orders:"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, kept := range map[string]bool{"orders:1": false, "orders:2": false, "users:1": true, "1": true} {
+		if _, err := cache.Get(ctx, key); (err == nil) != kept {
+			t.Errorf("Get(%q) error = %v, want kept %v", key, err, kept)
+		}
+	}
+}
+
+func TestSharedCacheChecksEveryRoute(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{"aud": "orders", "scope": "read:orders"})))
+	cache := NewMemoryCache(0)
+
+	route := func(audience, scope string) introspection.Config {
+		config := e.config()
+		config.Audience = []string{audience}
+		config.Scopes = []string{scope}
+		return config
+	}
+
+	app := fiber.New()
+	ok := func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) }
+	app.Get("/orders", New(Config{Config: route("orders", "read:orders"), Cache: cache}), ok)
+	app.Get("/orders/write", New(Config{Config: route("orders", "write:orders"), Cache: cache}), ok)
+	app.Get("/users", New(Config{Config: route("users", "read:orders"), Cache: cache}), ok)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/orders", fiber.StatusOK},
+		{"/orders/write", fiber.StatusForbidden},
+		{"/users", fiber.StatusForbidden},
+		{"/orders", fiber.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := send(t, app, newRequest(tt.path, "token")); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.path, got, tt.want)
+		}
+	}
+	if e.calls() != 1 {
+		t.Errorf("endpoint called %d times, want 1", e.calls())
+	}
+}
+
+func TestCacheKeyHashesToken(t *testing.T) {
+	const token = "secret-token"
+
+	e := newTestEndpoint(t, respondJSON(active(nil)))
+	cache := NewMemoryCache(0)
+	app := newTestApp(New(Config{Config: e.config(), Cache: cache, CacheKeySalt: "salt"}))
+
+	for n := 0; n < 2; n++ {
+		send(t, app, newRequest("/", token))
+	}
+	if e.calls() != 1 {
+		t.Errorf("endpoint called %d times, want 1", e.calls())
+	}
+
+	if len(cache.entries) != 1 {
+		t.Fatalf("cache holds %d entries, want 1", len(cache.entries))
+	}
+	for key := range cache.entries {
+		if strings.Contains(key, token) {
+			t.Errorf("cache key %q contains the token", key)
+		}
+		if key != cacheKey(token, "salt") || key == cacheKey(token, "") {
+			t.Errorf("cache key %q is not the salted hash of the token", key)
+		}
+	}
+}
+
+// wrappingCache wraps the errors of a MemoryCache, as rediscache wraps those
+// of its client.
+type wrappingCache struct {
+	*MemoryCache
+	err error
+}
+
+func (w wrappingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	data, err := w.MemoryCache.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping cache: %w", err)
+	}
+	return data, nil
+}
+
+func TestCacheMissWrapped(t *testing.T) {
+	down := errors.New("cache down")
+
+	for _, tt := range []struct {
+		name   string
+		err    error
+		logged bool
+	}{
+		{"miss", nil, false},
+		{"failure", down, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEndpoint(t, respondJSON(active(nil)))
+
+			var logged []error
+			app := newTestApp(New(Config{
+				Config: e.config(),
+				Cache:  wrappingCache{NewMemoryCache(0), tt.err},
+				Logger: func(_ *fiber.Ctx, event string, err error) {
+					if event == EventCacheError {
+						logged = append(logged, err)
+					}
+				},
+			}))
+
+			if got := send(t, app, newRequest("/", "token")); got != fiber.StatusOK {
+				t.Fatalf("status = %d, want %d", got, fiber.StatusOK)
+			}
+			if (len(logged) > 0) != tt.logged {
+				t.Errorf("cache errors logged = %v, want logged: %t", logged, tt.logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package introspect
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ErrCertMismatch is passed to Logger when Config.VerifyCertBound rejects a
+// request whose client certificate does not match its token.
+var ErrCertMismatch = errors.New("introspect: client certificate does not match the token")
+
+// verifyCertBound checks the TLS client certificate of c against the
+// cnf.x5t#S256 claim of result, see RFC 8705 section 3. Tokens without the
+// claim are not certificate-bound and pass.
+func verifyCertBound(c *fiber.Ctx, result *introspection.Result) error {
+	x5t, _ := lookupClaim(claimsOf(result), "cnf.x5t#S256")
+	thumbprint, _ := x5t.(string)
+	if thumbprint == "" {
+		return nil
+	}
+
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ErrCertMismatch
+	}
+
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	got := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(got), []byte(thumbprint)) != 1 {
+		return ErrCertMismatch
+	}
+	return nil
+}
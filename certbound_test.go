@@ -0,0 +1,118 @@
+package introspect
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// selfSignedCert creates a certificate for localhost.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func thumbprintOf(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// serveTLS serves app over TLS, requesting a client certificate, and
+// returns its URL.
+func serveTLS(t *testing.T, app *fiber.App) string {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(t)},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = app.Listener(ln) }()
+	t.Cleanup(func() { _ = app.Shutdown() })
+	return "https://" + ln.Addr().String()
+}
+
+func TestVerifyCertBound(t *testing.T) {
+	cert, other := selfSignedCert(t), selfSignedCert(t)
+
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{
+		"cnf": map[string]interface{}{"x5t#S256": thumbprintOf(cert)},
+	})))
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(New(Config{VerifyCertBound: true, Config: e.config()}))
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	url := serveTLS(t, app)
+
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		want  int
+	}{
+		{"matching certificate", []tls.Certificate{cert}, fiber.StatusOK},
+		{"other certificate", []tls.Certificate{other}, fiber.StatusForbidden},
+		{"no certificate", nil, fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				Certificates:       tt.certs,
+				InsecureSkipVerify: true,
+			}}}
+			defer client.CloseIdleConnections()
+
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer token")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyCertBoundWithoutTLS(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{
+		"cnf": map[string]interface{}{"x5t#S256": "thumbprint"},
+	})))
+	app := newTestApp(New(Config{VerifyCertBound: true, Config: e.config()}))
+
+	if got := send(t, app, newRequest("/", "token")); got != fiber.StatusForbidden {
+		t.Errorf("status = %d, want %d", got, fiber.StatusForbidden)
+	}
+}
@@ -0,0 +1,271 @@
+package introspect
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+)
+
+// claimsOf returns the claims of result keyed by their JSON names.
+// Extra claims are promoted to the top level unless they clash with a
+// standard claim.
+func claimsOf(result *introspection.Result) map[string]interface{} {
+	claims := make(map[string]interface{})
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return claims
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return claims
+	}
+
+	if extra, ok := claims["ext"].(map[string]interface{}); ok {
+		for k, v := range extra {
+			if _, exists := claims[k]; !exists {
+				claims[k] = v
+			}
+		}
+	}
+
+	return claims
+}
+
+// lookupClaim resolves a dotted path such as "org.id" in claims.
+func lookupClaim(claims map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// hasClaims reports whether every required claim is present in claims with
+// an equal value. The required values must have been normalized by
+// normalizeClaims.
+func hasClaims(claims map[string]interface{}, required map[string]interface{}) bool {
+	for path, want := range required {
+		got, ok := lookupClaim(claims, path)
+		if !ok || !reflect.DeepEqual(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeClaims returns a copy of required with each value given the form
+// encoding/json decodes it into, so that configured Go values compare equal
+// to decoded claims: numbers of any type become float64, slices
+// []interface{} and structs and maps map[string]interface{}. Values that
+// cannot be encoded are kept as they are and match no claim.
+func normalizeClaims(required map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{}, len(required))
+	for path, want := range required {
+		normalized[path] = want
+		data, err := json.Marshal(want)
+		if err != nil {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err == nil {
+			normalized[path] = value
+		}
+	}
+	return normalized
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// expired reports whether the exp claim of result is before now.
+func expired(result *introspection.Result, now time.Time) bool {
+	return result.Expires > 0 && now.After(time.Unix(result.Expires, 0))
+}
+
+// notBefore returns the nbf claim of result, which is kept in Extra.
+func notBefore(result *introspection.Result) (int64, bool) {
+	nbf, ok := toFloat(result.Extra["nbf"])
+	return int64(nbf), ok
+}
+
+// tokenID returns the jti claim of result, which is kept in Extra.
+func tokenID(result *introspection.Result) string {
+	jti, _ := result.Extra["jti"].(string)
+	return jti
+}
+
+// RequireRemainingLifetime returns a handler granting access only when the
+// token stored by the middleware expires at least d from now. Tokens without
+// an exp claim pass when allowMissingExp is true. The exp claim is checked
+// even when RedactClaims or ResultFields leave it out of the stored result.
+// It must run after New, like RequireScopes, and uses the Now, Forbidden and
+// Unauthorized of that middleware.
+func RequireRemainingLifetime(d time.Duration, allowMissingExp bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		m, ok := c.Locals(middlewareKey{}).(*Middleware)
+		if !ok {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		// The stored result may lack exp because of RedactClaims or
+		// ResultFields.
+		exp, ok := c.Locals(expiresKey{}).(int64)
+		if !ok {
+			m.cfg.Logger(c, EventUnauthorized, ErrMissingToken)
+			return m.unauthorized(c, ErrMissingToken)
+		}
+		if exp == 0 && allowMissingExp {
+			return c.Next()
+		}
+		if exp == 0 || time.Unix(exp, 0).Sub(m.cfg.Now()) < d {
+			m.cfg.Logger(c, EventForbidden, introspection.ErrForbidden)
+			return m.cfg.Forbidden(c)
+		}
+		return c.Next()
+	}
+}
+
+// redactClaims returns a copy of result without the named claims. Standard
+// claims are zeroed and extra ones removed; result itself, which may be
+// cached, is left untouched.
+func redactClaims(result *introspection.Result, claims []string) *introspection.Result {
+	redacted := *result
+	if len(result.Extra) > 0 {
+		redacted.Extra = make(map[string]interface{}, len(result.Extra))
+		for k, v := range result.Extra {
+			redacted.Extra[k] = v
+		}
+	}
+
+	for _, claim := range claims {
+		switch claim {
+		case "sub":
+			redacted.Subject = ""
+		case "username":
+			redacted.Username = ""
+		case "aud":
+			redacted.Audience = nil
+		case "token_type":
+			redacted.TokenType = ""
+		case "iss":
+			redacted.Issuer = ""
+		case "client_id":
+			redacted.ClientID = ""
+		case "scope":
+			redacted.Scope = ""
+		case "exp":
+			redacted.Expires = 0
+		case "token_use":
+			redacted.TokenUse = ""
+		default:
+			delete(redacted.Extra, claim)
+		}
+	}
+	return &redacted
+}
+
+// Fields is stored in place of the result when Config.ResultFields is set.
+// It holds the selected claims keyed by their JSON names.
+type Fields map[string]interface{}
+
+// selectFields copies the named claims of result into Fields, leaving out
+// the redacted ones, which still decode as zero values.
+func selectFields(result *introspection.Result, names, redacted []string) Fields {
+	claims := claimsOf(result)
+	fields := make(Fields, len(names))
+	for _, name := range names {
+		if containsString(redacted, name) {
+			continue
+		}
+		if v, ok := claims[name]; ok {
+			fields[name] = v
+		}
+	}
+	return fields
+}
+
+// Result rebuilds a partial introspection result from f. Claims that are not
+// standard result fields are placed in Extra.
+func (f Fields) Result() *introspection.Result {
+	var result introspection.Result
+
+	data, err := json.Marshal(map[string]interface{}(f))
+	if err == nil {
+		_ = json.Unmarshal(data, &result)
+	}
+
+	known := resultFieldNames()
+	for k, v := range f {
+		if _, ok := known[k]; ok {
+			continue
+		}
+		if result.Extra == nil {
+			result.Extra = make(map[string]interface{})
+		}
+		result.Extra[k] = v
+	}
+
+	return &result
+}
+
+var (
+	resultFieldsOnce sync.Once
+	resultFields     map[string]struct{}
+)
+
+// resultFieldNames returns the JSON names of the introspection.Result fields.
+func resultFieldNames() map[string]struct{} {
+	resultFieldsOnce.Do(func() {
+		resultFields = make(map[string]struct{})
+		t := reflect.TypeOf(introspection.Result{})
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = t.Field(i).Name
+			}
+			resultFields[name] = struct{}{}
+		}
+	})
+	return resultFields
+}
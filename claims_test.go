@@ -0,0 +1,227 @@
+package introspect
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRequireRemainingLifetime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name            string
+		exp             int64
+		allowMissingExp bool
+		want            int
+	}{
+		{"long enough", now.Add(time.Hour).Unix(), false, fiber.StatusOK},
+		{"exactly enough", now.Add(10 * time.Minute).Unix(), false, fiber.StatusOK},
+		{"too short", now.Add(time.Minute).Unix(), false, fiber.StatusTeapot},
+		{"too short with missing exp allowed", now.Add(time.Minute).Unix(), true, fiber.StatusTeapot},
+		{"missing exp", 0, false, fiber.StatusTeapot},
+		{"missing exp allowed", 0, true, fiber.StatusOK},
+	}
+
+	// The check must see exp however the result is stored.
+	stores := []struct {
+		name string
+		cfg  Config
+	}{
+		{"whole result", Config{}},
+		{"redacted exp", Config{RedactClaims: []string{"exp"}}},
+		{"result fields", Config{ResultFields: []string{"sub"}}},
+	}
+
+	for _, store := range stores {
+		for _, tt := range tests {
+			t.Run(store.name+"/"+tt.name, func(t *testing.T) {
+				claims := active(nil)
+				if tt.exp != 0 {
+					claims["exp"] = tt.exp
+				}
+				e := newTestEndpoint(t, respondJSON(claims))
+
+				cfg := store.cfg
+				cfg.Config = e.config()
+				cfg.Now = func() time.Time { return now }
+				cfg.Forbidden = func(c *fiber.Ctx) error {
+					return c.SendStatus(fiber.StatusTeapot)
+				}
+
+				app := fiber.New()
+				app.Use(New(cfg))
+				app.Get("/", RequireRemainingLifetime(10*time.Minute, tt.allowMissingExp), func(c *fiber.Ctx) error {
+					return c.SendStatus(fiber.StatusOK)
+				})
+
+				if got := send(t, app, newRequest("/", "token")); got != tt.want {
+					t.Errorf("status = %d, want %d", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestRedactScope(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{"scope": "orders:read admin"})))
+
+	var (
+		granted []string
+		stored  interface{}
+		scope   string
+	)
+	app := fiber.New()
+	app.Use(New(Config{Config: e.config(), RedactClaims: []string{"scope"}}))
+	app.Get("/", RequireScopes("admin"), func(c *fiber.Ctx) error {
+		granted = ScopesFromContext(c)
+		stored = c.Locals("user_scopes")
+		result, _ := FromContext(c)
+		scope = result.Scope
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	if got := send(t, app, newRequest("/", "token")); got != fiber.StatusOK {
+		t.Fatalf("status = %d, want %d", got, fiber.StatusOK)
+	}
+	if len(granted) != 0 || stored != nil || scope != "" {
+		t.Errorf("redacted scopes leaked: ScopesFromContext %q, ScopesContextKey %v, Scope %q", granted, stored, scope)
+	}
+}
+
+func TestRequiredClaims(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{
+		"username": "alice",
+		"ext": map[string]interface{}{
+			"level":    3,
+			"verified": true,
+			"groups":   []string{"a", "b"},
+			"org":      map[string]interface{}{"id": 42},
+		},
+	})))
+
+	tests := []struct {
+		name string
+		want map[string]interface{}
+		code int
+	}{
+		{"string", map[string]interface{}{"username": "alice"}, fiber.StatusOK},
+		{"other string", map[string]interface{}{"username": "bob"}, fiber.StatusForbidden},
+		{"int", map[string]interface{}{"level": 3}, fiber.StatusOK},
+		{"int64", map[string]interface{}{"level": int64(3)}, fiber.StatusOK},
+		{"uint8", map[string]interface{}{"level": uint8(3)}, fiber.StatusOK},
+		{"float", map[string]interface{}{"level": 3.0}, fiber.StatusOK},
+		{"json number", map[string]interface{}{"level": json.Number("3")}, fiber.StatusOK},
+		{"other number", map[string]interface{}{"level": 4}, fiber.StatusForbidden},
+		{"number as string", map[string]interface{}{"level": "3"}, fiber.StatusForbidden},
+		{"bool", map[string]interface{}{"verified": true}, fiber.StatusOK},
+		{"other bool", map[string]interface{}{"verified": false}, fiber.StatusForbidden},
+		{"string slice", map[string]interface{}{"groups": []string{"a", "b"}}, fiber.StatusOK},
+		{"interface slice", map[string]interface{}{"groups": []interface{}{"a", "b"}}, fiber.StatusOK},
+		{"slice out of order", map[string]interface{}{"groups": []string{"b", "a"}}, fiber.StatusForbidden},
+		{"slice subset", map[string]interface{}{"groups": []string{"a"}}, fiber.StatusForbidden},
+		{"nested", map[string]interface{}{"org.id": 42}, fiber.StatusOK},
+		{"map", map[string]interface{}{"org": map[string]int{"id": 42}}, fiber.StatusOK},
+		{"struct", map[string]interface{}{"org": struct {
+			ID int `json:"id"`
+		}{42}}, fiber.StatusOK},
+		{"missing", map[string]interface{}{"tenant": "acme"}, fiber.StatusForbidden},
+		{"missing nested", map[string]interface{}{"org.name": "acme"}, fiber.StatusForbidden},
+		{"not encodable", map[string]interface{}{"level": func() int { return 3 }}, fiber.StatusForbidden},
+		{"all", map[string]interface{}{"username": "alice", "level": 3, "verified": true}, fiber.StatusOK},
+		{"all but one", map[string]interface{}{"username": "alice", "level": 3, "verified": false}, fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(New(Config{Config: e.config(), RequiredClaims: tt.want}))
+			if got := send(t, app, newRequest("/", "token")); got != tt.code {
+				t.Errorf("status = %d, want %d", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestClaimsToLocals(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{
+		"username": "alice@example.com",
+		"ext":      map[string]interface{}{"org": map[string]interface{}{"id": "acme"}},
+	})))
+
+	locals := map[string]string{"sub": "user_id", "org.id": "org_id", "username": "email", "tenant": "tenant"}
+	tests := []struct {
+		name   string
+		redact []string
+		want   map[string]interface{}
+	}{
+		{"every claim", nil, map[string]interface{}{"user_id": "alice", "org_id": "acme", "email": "alice@example.com", "tenant": nil}},
+		{"redacted", []string{"username"}, map[string]interface{}{"user_id": "alice", "org_id": "acme", "email": nil, "tenant": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(New(Config{Config: e.config(), ClaimsToLocals: locals, RedactClaims: tt.redact}))
+
+			got := make(map[string]interface{})
+			app.Get("/", func(c *fiber.Ctx) error {
+				for _, key := range locals {
+					got[key] = c.Locals(key)
+				}
+				return nil
+			})
+
+			send(t, app, newRequest("/", "token"))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("locals = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultFields(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{
+		"username": "alice@example.com",
+		"scope":    "read",
+		"ext":      map[string]interface{}{"org": "acme", "groups": []string{"admins"}},
+	})))
+
+	tests := []struct {
+		name   string
+		redact []string
+		want   Fields
+	}{
+		{"selected", nil, Fields{"sub": "alice", "username": "alice@example.com", "org": "acme"}},
+		{"selected and redacted", []string{"username", "org"}, Fields{"sub": "alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(New(Config{
+				Config:       e.config(),
+				ResultFields: []string{"sub", "username", "org", "missing"},
+				RedactClaims: tt.redact,
+			}))
+
+			var (
+				stored interface{}
+				result *introspection.Result
+			)
+			app.Get("/", func(c *fiber.Ctx) error {
+				stored = c.Locals("user")
+				result, _ = FromContext(c)
+				return nil
+			})
+
+			send(t, app, newRequest("/", "token"))
+			if !reflect.DeepEqual(stored, tt.want) {
+				t.Errorf("stored = %#v, want %#v", stored, tt.want)
+			}
+			if result == nil || result.Subject != "alice" || result.Scope != "" || result.Extra["groups"] != nil {
+				t.Errorf("FromContext = %+v, want only the selected claims", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package introspect
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// client introspects tokens against config.IntrospectionURL using its own
+// *http.Client. It mirrors the checks done by the introspection package and
+// is the default Introspector, so that claims the introspection package does
+// not decode, such as cnf, nbf and jti, reach the checks of the middleware
+// whatever options are set.
+type client struct {
+	config        introspection.Config
+	http          *http.Client
+	tokenTypeHint string
+	clientID      string
+	clientSecret  string
+	authMethod    ClientAuthMethod
+	credentials   func() (id, secret string)
+}
+
+// newIntrospector creates the client of endpoint, which falls back to the
+// credentials of cfg when it has none of its own.
+func newIntrospector(cfg Config, endpoint Endpoint) Introspector {
+	if endpoint.ClientID == "" && endpoint.CredentialsProvider == nil {
+		endpoint.ClientID, endpoint.ClientSecret = cfg.ClientID, cfg.ClientSecret
+		endpoint.CredentialsProvider = cfg.CredentialsProvider
+	}
+
+	c := &client{
+		config:        endpoint.Config,
+		http:          cfg.HTTPClient,
+		tokenTypeHint: cfg.TokenTypeHint,
+		clientID:      endpoint.ClientID,
+		clientSecret:  endpoint.ClientSecret,
+		authMethod:    cfg.ClientAuthMethod,
+		credentials:   endpoint.CredentialsProvider,
+	}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	return c
+}
+
+// Introspect implements Introspector.
+func (i *client) Introspect(token string) (*introspection.Result, error) {
+	return i.IntrospectContext(context.Background(), token)
+}
+
+// IntrospectContext implements contextIntrospector.
+func (i *client) IntrospectContext(ctx context.Context, token string) (*introspection.Result, error) {
+	form := url.Values{"token": {token}}
+	if i.tokenTypeHint != "" {
+		form.Set("token_type_hint", i.tokenTypeHint)
+	}
+
+	for k, v := range extraParams(ctx) {
+		form[k] = v
+	}
+
+	id, secret := i.clientID, i.clientSecret
+	if i.credentials != nil {
+		id, secret = i.credentials()
+	}
+
+	if id != "" && i.authMethod == ClientAuthPost {
+		form.Set("client_id", id)
+		form.Set("client_secret", secret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.config.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range propagatedHeaders(ctx) {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	for k, v := range i.config.IntrospectionRequestHeaders {
+		req.Header.Set(k, v)
+	}
+
+	// RFC 6749 section 2.3.1 requires both to be form-encoded first.
+	if id != "" && i.authMethod != ClientAuthPost {
+		req.SetBasicAuth(url.QueryEscape(id), url.QueryEscape(secret))
+	}
+
+	resp, err := i.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &RateLimitError{RetryAfter: resp.Header.Get("Retry-After")}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspect: introspection endpoint responded with status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		introspection.Result
+		Audience     audience               `json:"aud"`
+		NotBefore    int64                  `json:"nbf"`
+		Confirmation map[string]interface{} `json:"cnf"`
+		ID           string                 `json:"jti"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+	}
+
+	result := body.Result
+	result.Audience = body.Audience
+	if body.NotBefore > 0 {
+		setExtra(&result, "nbf", body.NotBefore)
+	}
+	if body.Confirmation != nil {
+		setExtra(&result, "cnf", body.Confirmation)
+	}
+	if body.ID != "" {
+		setExtra(&result, "jti", body.ID)
+	}
+
+	if !result.Active {
+		return nil, introspection.ErrUnauthorized
+	}
+
+	if !allowedBy(i.config, &result) {
+		return nil, introspection.ErrForbidden
+	}
+
+	return &result, nil
+}
+
+// allowedBy reports whether result has every audience and one of the
+// issuers required by config.
+func allowedBy(config introspection.Config, result *introspection.Result) bool {
+	for _, aud := range config.Audience {
+		if !containsString(result.Audience, aud) {
+			return false
+		}
+	}
+	return len(config.Issuers) == 0 || containsString(config.Issuers, result.Issuer)
+}
+
+// extraParamsKey is the context key of the ExtraParams of a request.
+type extraParamsKey struct{}
+
+// reservedParams cannot be set by ExtraParams.
+var reservedParams = map[string]struct{}{
+	"token":           {},
+	"token_type_hint": {},
+	"client_id":       {},
+	"client_secret":   {},
+}
+
+// withExtraParams returns a copy of ctx carrying params, minus the reserved
+// ones. They are copied as they may be used after the request.
+func withExtraParams(ctx context.Context, params map[string]string) context.Context {
+	values := make(url.Values, len(params))
+	for k, v := range params {
+		if _, ok := reservedParams[k]; !ok {
+			values.Set(utils.CopyString(k), utils.CopyString(v))
+		}
+	}
+	if len(values) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, extraParamsKey{}, values)
+}
+
+// extraParams returns the ExtraParams carried by ctx, if any.
+func extraParams(ctx context.Context) url.Values {
+	values, _ := ctx.Value(extraParamsKey{}).(url.Values)
+	return values
+}
+
+// propagatedHeadersKey is the context key of the PropagateHeaders of a
+// request.
+type propagatedHeadersKey struct{}
+
+// withPropagatedHeaders returns a copy of ctx carrying the headers of c
+// listed in names. They are copied as they may be used after the request.
+func withPropagatedHeaders(ctx context.Context, c *fiber.Ctx, names []string) context.Context {
+	header := make(http.Header, len(names))
+	for _, name := range names {
+		if v := c.Get(name); v != "" {
+			header.Set(name, utils.CopyString(v))
+		}
+	}
+	if len(header) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, propagatedHeadersKey{}, header)
+}
+
+// propagatedHeaders returns the PropagateHeaders carried by ctx, if any.
+func propagatedHeaders(ctx context.Context) http.Header {
+	header, _ := ctx.Value(propagatedHeadersKey{}).(http.Header)
+	return header
+}
+
+// setExtra keeps a top-level claim the introspection package has no field
+// for in result.Extra.
+func setExtra(result *introspection.Result, claim string, value interface{}) {
+	if result.Extra == nil {
+		result.Extra = make(map[string]interface{})
+	}
+	result.Extra[claim] = value
+}
+
+// audience decodes an aud claim given either as a string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IssuerFromJWT is an EndpointResolver returning the iss claim of a JWT
+// without verifying it. Opaque tokens resolve to "".
+func IssuerFromJWT(_ *fiber.Ctx, token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
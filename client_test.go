@@ -0,0 +1,236 @@
+package introspect
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMalformedResponse(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("not-json"))
+	})
+
+	for _, failOpen := range []bool{false, true} {
+		var got error
+		app := newTestApp(New(Config{
+			Config:   e.config(),
+			FailOpen: failOpen,
+			ErrorHandler: func(c *fiber.Ctx, err error) error {
+				got = err
+				return c.SendStatus(fiber.StatusInternalServerError)
+			},
+		}))
+
+		if status := send(t, app, newRequest("/", "token")); status != fiber.StatusInternalServerError {
+			t.Errorf("FailOpen %v: status = %d, want %d", failOpen, status, fiber.StatusInternalServerError)
+		}
+		if !errors.Is(got, ErrMalformedResponse) {
+			t.Errorf("FailOpen %v: ErrorHandler got %v, want ErrMalformedResponse", failOpen, got)
+		}
+	}
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(nil)))
+
+	var used int
+	app := newTestApp(New(Config{
+		Config: e.config(),
+		HTTPClient: &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			used++
+			req = req.Clone(req.Context())
+			req.Header.Set("X-Transport", "custom")
+			return http.DefaultTransport.RoundTrip(req)
+		})},
+	}))
+
+	if got := send(t, app, newRequest("/", "token")); got != fiber.StatusOK {
+		t.Fatalf("status = %d, want %d", got, fiber.StatusOK)
+	}
+	if used != 1 {
+		t.Errorf("transport used %d times, want 1", used)
+	}
+	if got := e.last(t).Header.Get("X-Transport"); got != "custom" {
+		t.Errorf("X-Transport = %q, want %q", got, "custom")
+	}
+}
+
+func TestTokenTypeHint(t *testing.T) {
+	for _, hint := range []string{"", "access_token"} {
+		e := newTestEndpoint(t, respondJSON(active(nil)))
+		app := newTestApp(New(Config{Config: e.config(), TokenTypeHint: hint}))
+
+		send(t, app, newRequest("/", "token"))
+		form := e.last(t).PostForm
+		if got := form.Get("token_type_hint"); got != hint || form.Has("token_type_hint") != (hint != "") {
+			t.Errorf("TokenTypeHint %q: introspection form = %v", hint, form)
+		}
+	}
+}
+
+func TestClientAuthPost(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok ||
+			r.PostForm.Get("client_id") != "client" || r.PostForm.Get("client_secret") != "s3cr&t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		respondJSON(active(nil))(w, r)
+	})
+
+	tests := []struct {
+		method ClientAuthMethod
+		want   int
+	}{
+		{ClientAuthPost, fiber.StatusOK},
+		{ClientAuthBasic, fiber.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		app := newTestApp(New(Config{
+			Config:           e.config(),
+			ClientID:         "client",
+			ClientSecret:     "s3cr&t",
+			ClientAuthMethod: tt.method,
+		}))
+
+		if got := send(t, app, newRequest("/", "token")); got != tt.want {
+			t.Errorf("ClientAuthMethod %q: status = %d, want %d", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestPropagateHeaders(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(nil)))
+	app := newTestApp(New(Config{
+		Config:           e.config(),
+		PropagateHeaders: []string{"X-Request-Id", "Traceparent", "X-Missing"},
+	}))
+
+	req := newRequest("/", "token")
+	req.Header.Set("X-Request-Id", "request-1")
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Set("X-Other", "kept back")
+	send(t, app, req)
+
+	header := e.last(t).Header
+	if got := header.Get("X-Request-Id"); got != "request-1" {
+		t.Errorf("X-Request-Id = %q, want %q", got, "request-1")
+	}
+	if got := header.Get("Traceparent"); got != req.Header.Get("Traceparent") {
+		t.Errorf("Traceparent = %q, want %q", got, req.Header.Get("Traceparent"))
+	}
+	if _, ok := header["X-Missing"]; ok {
+		t.Error("absent header was propagated")
+	}
+	if got := header.Get("X-Other"); got != "" {
+		t.Errorf("X-Other = %q, want it not propagated", got)
+	}
+}
+
+func TestEndpointCredentials(t *testing.T) {
+	shared := newTestEndpoint(t, requireBasicAuth("shared", "shared-secret", respondJSON(active(nil))))
+	own := newTestEndpoint(t, requireBasicAuth("own", "own-secret", respondJSON(active(nil))))
+	rotated := newTestEndpoint(t, requireBasicAuth("rotated", "rotated-secret", respondJSON(active(nil))))
+
+	app := newTestApp(New(Config{
+		Endpoints: map[string]Endpoint{
+			"shared": {Config: shared.config()},
+			"own":    {Config: own.config(), ClientID: "own", ClientSecret: "own-secret"},
+			"rotated": {Config: rotated.config(), CredentialsProvider: func() (string, string) {
+				return "rotated", "rotated-secret"
+			}},
+		},
+		EndpointResolver: func(c *fiber.Ctx, _ string) string {
+			return c.Get("X-Issuer")
+		},
+		ClientID:     "shared",
+		ClientSecret: "shared-secret",
+	}))
+
+	for _, issuer := range []string{"shared", "own", "rotated"} {
+		req := newRequest("/", "token")
+		req.Header.Set("X-Issuer", issuer)
+		if got := send(t, app, req); got != fiber.StatusOK {
+			t.Errorf("Endpoints[%q]: status = %d, want %d", issuer, got, fiber.StatusOK)
+		}
+	}
+}
+
+func TestCredentialsProvider(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		secret = "first"
+	)
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		want := secret
+		mu.Unlock()
+		requireBasicAuth("client", want, respondJSON(active(nil)))(w, r)
+	})
+
+	var calls int
+	app := newTestApp(New(Config{
+		Config:       e.config(),
+		Cache:        NewMemoryCache(0),
+		ClientID:     "ignored",
+		ClientSecret: "ignored",
+		CredentialsProvider: func() (string, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			return "client", secret
+		},
+	}))
+
+	if got := send(t, app, newRequest("/", "first")); got != fiber.StatusOK {
+		t.Errorf("status = %d, want %d", got, fiber.StatusOK)
+	}
+
+	// The rotated secret is used right away, without a restart.
+	mu.Lock()
+	secret = "second"
+	mu.Unlock()
+	if got := send(t, app, newRequest("/", "second")); got != fiber.StatusOK {
+		t.Errorf("after rotation: status = %d, want %d", got, fiber.StatusOK)
+	}
+
+	// Cached results need no credentials.
+	send(t, app, newRequest("/", "second"))
+	if calls != 2 {
+		t.Errorf("provider called %d times, want 2", calls)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	e := newTestEndpoint(t, requireBasicAuth("my%3Aclient", "s3cr%26t", respondJSON(active(nil))))
+
+	tests := []struct {
+		name   string
+		id     string
+		secret string
+		want   int
+	}{
+		{"form-encoded", "my:client", "s3cr&t", fiber.StatusOK},
+		{"wrong secret", "my:client", "secret", fiber.StatusInternalServerError},
+		{"none", "", "", fiber.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(New(Config{Config: e.config(), ClientID: tt.id, ClientSecret: tt.secret}))
+			if got := send(t, app, newRequest("/", "token")); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
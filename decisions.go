@@ -0,0 +1,172 @@
+package introspect
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// maxDecisionRoutes is the number of paths decisions are remembered for per
+// token, bounding what a single token crawling many paths can hold.
+const maxDecisionRoutes = 64
+
+// decision is the outcome of the checks for a token on a route, remembered
+// for Config.DecisionCacheTTL. A nil result is a denial.
+type decision struct {
+	result  *introspection.Result
+	scopes  []string
+	err     error
+	missing []string
+	expires time.Time
+}
+
+type decisionEntry struct {
+	token  string
+	routes map[string]*decision
+}
+
+// decisionCache is the in-process layer in front of Config.Cache. Decisions
+// are grouped by token so that invalidating a token drops them for every
+// route. It holds at most size tokens, evicting the least recently used. A
+// nil decisionCache remembers nothing.
+type decisionCache struct {
+	mu     sync.Mutex
+	size   int
+	now    func() time.Time
+	tokens map[string]*list.Element
+	order  *list.List
+}
+
+func newDecisionCache(ttl time.Duration, size int, now func() time.Time) *decisionCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &decisionCache{
+		size:   size,
+		now:    now,
+		tokens: make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// decisionRoute identifies the request path of c, plus the ExtraParams
+// carried by ctx since they may change the result. The route pattern is not
+// enough: a middleware mounted with Use sees its own route for every path
+// below it.
+func decisionRoute(ctx context.Context, c *fiber.Ctx) string {
+	route := c.Method() + " " + utils.CopyString(c.Path())
+	if params := extraParams(ctx); len(params) > 0 {
+		route += "\x00" + params.Encode()
+	}
+	return route
+}
+
+func (d *decisionCache) get(token, route string) *decision {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	el, ok := d.tokens[token]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*decisionEntry)
+	dec, ok := entry.routes[route]
+	if !ok {
+		return nil
+	}
+	if d.now().After(dec.expires) {
+		delete(entry.routes, route)
+		return nil
+	}
+
+	d.order.MoveToFront(el)
+	return dec
+}
+
+func (d *decisionCache) set(token, route string, dec *decision) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.tokens[token]; ok {
+		entry := el.Value.(*decisionEntry)
+		if _, ok := entry.routes[route]; !ok && len(entry.routes) >= maxDecisionRoutes {
+			return
+		}
+		entry.routes[route] = dec
+		d.order.MoveToFront(el)
+		return
+	}
+
+	d.tokens[token] = d.order.PushFront(&decisionEntry{
+		token:  token,
+		routes: map[string]*decision{route: dec},
+	})
+	if d.size > 0 && d.order.Len() > d.size {
+		d.remove(d.order.Back())
+	}
+}
+
+// delete drops the decisions for token on every route.
+func (d *decisionCache) delete(token string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.tokens[token]; ok {
+		d.remove(el)
+	}
+}
+
+func (d *decisionCache) clear() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.tokens = make(map[string]*list.Element)
+	d.order.Init()
+}
+
+// Purge implements purger.
+func (d *decisionCache) Purge() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	for el := d.order.Back(); el != nil; {
+		prev := el.Prev()
+		entry := el.Value.(*decisionEntry)
+		for route, dec := range entry.routes {
+			if now.After(dec.expires) {
+				delete(entry.routes, route)
+			}
+		}
+		if len(entry.routes) == 0 {
+			d.remove(el)
+		}
+		el = prev
+	}
+}
+
+func (d *decisionCache) remove(el *list.Element) {
+	d.order.Remove(el)
+	delete(d.tokens, el.Value.(*decisionEntry).token)
+}
@@ -0,0 +1,74 @@
+package introspect
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestDecisionCacheUse(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(nil)))
+	m := newTestMiddleware(t, Config{
+		Config:           e.config(),
+		DecisionCacheTTL: time.Minute,
+		ClaimsValidator: func(c *fiber.Ctx, _ *introspection.Result) error {
+			if c.Path() == "/admin" {
+				return errors.New("admins only")
+			}
+			return nil
+		},
+	})
+	app := newTestApp(m.Handler())
+
+	steps := []struct {
+		path string
+		want int
+	}{
+		{"/orders", fiber.StatusOK},
+		{"/admin", fiber.StatusForbidden},
+		{"/orders", fiber.StatusOK},
+		{"/admin", fiber.StatusForbidden},
+	}
+	for _, step := range steps {
+		if got := send(t, app, newRequest(step.path, "token")); got != step.want {
+			t.Errorf("%s: status = %d, want %d", step.path, got, step.want)
+		}
+	}
+
+	stats := m.Stats()
+	if stats.DecisionHits != 2 || stats.DecisionMisses != 2 {
+		t.Errorf("decision hits %d and misses %d, want 2 and 2", stats.DecisionHits, stats.DecisionMisses)
+	}
+	if stats.CacheHits != 0 {
+		t.Errorf("decision hits counted as %d cache hits", stats.CacheHits)
+	}
+	if e.calls() != 2 {
+		t.Errorf("endpoint called %d times, want 2", e.calls())
+	}
+
+	if err := m.InvalidateToken("token"); err != nil {
+		t.Fatal(err)
+	}
+	send(t, app, newRequest("/orders", "token"))
+	if e.calls() != 3 {
+		t.Errorf("endpoint called %d times after InvalidateToken, want 3", e.calls())
+	}
+}
+
+func TestDecisionCacheRoutesPerToken(t *testing.T) {
+	d := newDecisionCache(time.Minute, 0, time.Now)
+	dec := &decision{expires: time.Now().Add(time.Minute)}
+
+	for n := 0; n <= maxDecisionRoutes; n++ {
+		d.set("token", string(rune('a'+n)), dec)
+	}
+	if d.get("token", "a") == nil {
+		t.Error("first route was dropped")
+	}
+	if d.get("token", string(rune('a'+maxDecisionRoutes))) != nil {
+		t.Error("route beyond the limit was remembered")
+	}
+}
@@ -0,0 +1,242 @@
+package introspect
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512 for ES384, RS512 and alike
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ErrInvalidDPoP is passed to Logger when Config.VerifyDPoP rejects the DPoP
+// proof of a request.
+var ErrInvalidDPoP = errors.New("introspect: invalid DPoP proof")
+
+// dpopMaxAge is how long after its iat a DPoP proof is accepted.
+const dpopMaxAge = 5 * time.Minute
+
+// verifyDPoP checks the DPoP proof of c against the cnf.jkt claim of result,
+// see RFC 9449 section 4.3. Tokens without cnf.jkt are not DPoP-bound and
+// pass. Proofs are not checked for replay.
+func verifyDPoP(c *fiber.Ctx, token string, result *introspection.Result, skew time.Duration, now time.Time) error {
+	jkt, _ := lookupClaim(claimsOf(result), "cnf.jkt")
+	thumbprint, _ := jkt.(string)
+	if thumbprint == "" {
+		return nil
+	}
+
+	proofs := c.Request().Header.PeekAll("DPoP")
+	if len(proofs) != 1 {
+		return ErrInvalidDPoP
+	}
+
+	parts := strings.Split(string(proofs[0]), ".")
+	if len(parts) != 3 {
+		return ErrInvalidDPoP
+	}
+
+	var header struct {
+		Type      string `json:"typ"`
+		Algorithm string `json:"alg"`
+		Key       jwk    `json:"jwk"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Type != "dpop+jwt" {
+		return ErrInvalidDPoP
+	}
+
+	got, err := header.Key.thumbprint()
+	if err != nil || subtle.ConstantTimeCompare([]byte(got), []byte(thumbprint)) != 1 {
+		return ErrInvalidDPoP
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !header.Key.verify(header.Algorithm, []byte(parts[0]+"."+parts[1]), signature) {
+		return ErrInvalidDPoP
+	}
+
+	var claims struct {
+		Method   string `json:"htm"`
+		URI      string `json:"htu"`
+		IssuedAt int64  `json:"iat"`
+		ID       string `json:"jti"`
+		Hash     string `json:"ath"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.ID == "" {
+		return ErrInvalidDPoP
+	}
+
+	if claims.Method != c.Method() || !matchHTU(claims.URI, c) {
+		return ErrInvalidDPoP
+	}
+
+	iat := time.Unix(claims.IssuedAt, 0)
+	if iat.After(now.Add(skew)) || iat.Before(now.Add(-dpopMaxAge-skew)) {
+		return ErrInvalidDPoP
+	}
+
+	ath := sha256.Sum256([]byte(token))
+	if claims.Hash != base64.RawURLEncoding.EncodeToString(ath[:]) {
+		return ErrInvalidDPoP
+	}
+
+	return nil
+}
+
+// matchHTU compares the htu claim with the URL of c, ignoring its query and
+// fragment.
+func matchHTU(htu string, c *fiber.Ctx) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, c.Protocol()) &&
+		strings.EqualFold(u.Host, c.Hostname()) &&
+		strings.TrimSuffix(u.Path, "/") == strings.TrimSuffix(c.Path(), "/")
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwk is a public JSON Web Key, see RFC 7517.
+type jwk struct {
+	Type  string `json:"kty"`
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+}
+
+// thumbprint computes the RFC 7638 SHA-256 thumbprint of k. Marshalling a
+// map sorts its keys as the canonical form requires.
+func (k jwk) thumbprint() (string, error) {
+	var members map[string]string
+	switch k.Type {
+	case "EC":
+		members = map[string]string{"crv": k.Curve, "kty": k.Type, "x": k.X, "y": k.Y}
+	case "RSA":
+		members = map[string]string{"e": k.E, "kty": k.Type, "n": k.N}
+	case "OKP":
+		members = map[string]string{"crv": k.Curve, "kty": k.Type, "x": k.X}
+	default:
+		return "", ErrInvalidDPoP
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// verify checks signature over input with k for the JWS algorithm alg.
+func (k jwk) verify(alg string, input, signature []byte) bool {
+	switch alg {
+	case "ES256", "ES384", "ES512":
+		return k.verifyECDSA(alg, input, signature)
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		return k.verifyRSA(alg, input, signature)
+	case "EdDSA":
+		if k.Type != "OKP" || k.Curve != "Ed25519" {
+			return false
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(ed25519.PublicKey(x), input, signature)
+	}
+	return false
+}
+
+func (k jwk) verifyECDSA(alg string, input, signature []byte) bool {
+	var (
+		curve elliptic.Curve
+		hash  crypto.Hash
+	)
+	switch {
+	case alg == "ES256" && k.Curve == "P-256":
+		curve, hash = elliptic.P256(), crypto.SHA256
+	case alg == "ES384" && k.Curve == "P-384":
+		curve, hash = elliptic.P384(), crypto.SHA384
+	case alg == "ES512" && k.Curve == "P-521":
+		curve, hash = elliptic.P521(), crypto.SHA512
+	default:
+		return false
+	}
+	if k.Type != "EC" {
+		return false
+	}
+
+	x, errX := base64.RawURLEncoding.DecodeString(k.X)
+	y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+	if errX != nil || errY != nil {
+		return false
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return false
+	}
+
+	size := (curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+
+	h := hash.New()
+	h.Write(input)
+	return ecdsa.Verify(key, h.Sum(nil), r, s)
+}
+
+func (k jwk) verifyRSA(alg string, input, signature []byte) bool {
+	if k.Type != "RSA" {
+		return false
+	}
+
+	n, errN := base64.RawURLEncoding.DecodeString(k.N)
+	e, errE := base64.RawURLEncoding.DecodeString(k.E)
+	if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+		return false
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	default:
+		hash = crypto.SHA512
+	}
+
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	if alg[0] == 'P' {
+		return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	}
+	return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+}
@@ -0,0 +1,111 @@
+package introspect
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// dpopKey is a key DPoP proofs are signed with in tests.
+type dpopKey struct {
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+func newDPoPKey(t *testing.T) dpopKey {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dpopKey{public, private}
+}
+
+func (k dpopKey) jwk() jwk {
+	return jwk{Type: "OKP", Curve: "Ed25519", X: base64.RawURLEncoding.EncodeToString(k.public)}
+}
+
+func (k dpopKey) thumbprint(t *testing.T) string {
+	t.Helper()
+
+	thumbprint, err := k.jwk().thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return thumbprint
+}
+
+// proof signs a DPoP proof of a GET request for htu carrying token.
+func (k dpopKey) proof(t *testing.T, htu, token string, iat time.Time) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	ath := sha256.Sum256([]byte(token))
+	input := encode(map[string]interface{}{"typ": "dpop+jwt", "alg": "EdDSA", "jwk": k.jwk()}) + "." +
+		encode(map[string]interface{}{
+			"htm": fiber.MethodGet,
+			"htu": htu,
+			"iat": iat.Unix(),
+			"jti": "proof-1",
+			"ath": base64.RawURLEncoding.EncodeToString(ath[:]),
+		})
+	return input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(k.private, []byte(input)))
+}
+
+func TestVerifyDPoP(t *testing.T) {
+	key, other := newDPoPKey(t), newDPoPKey(t)
+	now := time.Now()
+
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{
+		"cnf": map[string]interface{}{"jkt": key.thumbprint(t)},
+	})))
+	app := newTestApp(New(Config{VerifyDPoP: true, Config: e.config()}))
+
+	tests := []struct {
+		name  string
+		proof string
+		want  int
+	}{
+		{"valid proof", key.proof(t, "http://example.com/orders", "token", now), fiber.StatusOK},
+		{"missing proof", "", fiber.StatusForbidden},
+		{"other key", other.proof(t, "http://example.com/orders", "token", now), fiber.StatusForbidden},
+		{"other URL", key.proof(t, "http://example.com/users", "token", now), fiber.StatusForbidden},
+		{"other token", key.proof(t, "http://example.com/orders", "stolen", now), fiber.StatusForbidden},
+		{"stale proof", key.proof(t, "http://example.com/orders", "token", now.Add(-time.Hour)), fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest("http://example.com/orders", "token")
+			if tt.proof != "" {
+				req.Header.Set("DPoP", tt.proof)
+			}
+			if got := send(t, app, req); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyDPoPUnboundToken(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(nil)))
+	app := newTestApp(New(Config{VerifyDPoP: true, Config: e.config()}))
+
+	if got := send(t, app, newRequest("/", "token")); got != http.StatusOK {
+		t.Errorf("status = %d, want %d", got, http.StatusOK)
+	}
+}
@@ -0,0 +1,37 @@
+package introspect
+
+import (
+	"context"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+)
+
+// fallbackIntrospector tries each introspector in order until one gives a
+// verdict. Only failures to obtain one, such as transport errors, move on
+// to the next introspector.
+type fallbackIntrospector []Introspector
+
+// Introspect implements Introspector.
+func (f fallbackIntrospector) Introspect(token string) (*introspection.Result, error) {
+	return f.IntrospectContext(context.Background(), token)
+}
+
+// IntrospectContext implements contextIntrospector. The error of the last
+// introspector is returned when all of them fail.
+func (f fallbackIntrospector) IntrospectContext(ctx context.Context, token string) (*introspection.Result, error) {
+	var (
+		result *introspection.Result
+		err    error
+	)
+	for _, i := range f {
+		result, err = introspectContext(ctx, i, token)
+		switch err {
+		case nil, introspection.ErrUnauthorized, introspection.ErrForbidden:
+			return result, err
+		}
+		if ctx.Err() != nil {
+			return nil, contextError(ctx)
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,62 @@
+package introspect
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestFallbacks(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary http.HandlerFunc
+		want    int
+		calls   int
+	}{
+		{"primary answers", respondJSON(active(nil)), fiber.StatusOK, 0},
+		{"primary inactive", respondJSON(map[string]interface{}{"active": false}), fiber.StatusUnauthorized, 0},
+		{"primary down", respondStatus(http.StatusServiceUnavailable), fiber.StatusOK, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newTestEndpoint(t, requireBasicAuth("primary", "primary-secret", tt.primary))
+			replica := newTestEndpoint(t, requireBasicAuth("replica", "replica-secret", respondJSON(active(nil))))
+
+			app := newTestApp(New(Config{
+				Config:       primary.config(),
+				ClientID:     "primary",
+				ClientSecret: "primary-secret",
+				Fallbacks:    []Endpoint{{Config: replica.config(), ClientID: "replica", ClientSecret: "replica-secret"}},
+			}))
+
+			if got := send(t, app, newRequest("/", "token")); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+			if replica.calls() != tt.calls {
+				t.Errorf("fallback called %d times, want %d", replica.calls(), tt.calls)
+			}
+		})
+	}
+}
+
+func TestFallbacksExhausted(t *testing.T) {
+	primary := newTestEndpoint(t, respondStatus(http.StatusServiceUnavailable))
+	replica := newTestEndpoint(t, requireBasicAuth("replica", "replica-secret", respondJSON(active(nil))))
+
+	// Without credentials of its own the replica is sent those of Config,
+	// which it rejects, so every endpoint fails and ErrorHandler responds.
+	app := newTestApp(New(Config{
+		Config:       primary.config(),
+		ClientID:     "primary",
+		ClientSecret: "primary-secret",
+		Fallbacks:    []Endpoint{{Config: replica.config()}},
+	}))
+
+	if got := send(t, app, newRequest("/", "token")); got != fiber.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", got, fiber.StatusInternalServerError)
+	}
+	if primary.calls() != 1 || replica.calls() != 1 {
+		t.Errorf("endpoints called %d and %d times, want 1 and 1", primary.calls(), replica.calls())
+	}
+}
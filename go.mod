@@ -1,8 +1,25 @@
 module github.com/arsmn/fiber-introspect
 
-go 1.11
+go 1.19
 
 require (
 	github.com/arsmn/oauth2-introspection v0.0.1
-	github.com/gofiber/fiber v1.10.5
+	github.com/gofiber/fiber/v2 v2.40.1
+	github.com/redis/go-redis/v9 v9.0.5
+	golang.org/x/sync v0.1.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.4 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.16 // indirect
+	github.com/mattn/go-runewidth v0.0.14 // indirect
+	github.com/rivo/uniseg v0.2.0 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/fasthttp v1.41.0 // indirect
+	github.com/valyala/tcplisten v1.0.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 )
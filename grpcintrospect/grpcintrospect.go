@@ -0,0 +1,150 @@
+// Package grpcintrospect provides an introspect.Introspector calling a gRPC
+// token service, such as a validation sidecar, instead of an RFC 7662
+// endpoint.
+package grpcintrospect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	introspect "github.com/arsmn/fiber-introspect"
+	introspection "github.com/arsmn/oauth2-introspection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var _ introspect.Introspector = (*Introspector)(nil)
+
+// Config configures the calls of an Introspector. The defaults exchange
+// google.protobuf.Struct messages: the request holds the token under
+// "token" and the response the RFC 7662 claims under their usual names.
+type Config struct {
+	// Method is the full name of the gRPC method to call, e.g.
+	// "/token.v1.TokenService/Introspect".
+	// Required.
+	Method string
+
+	// NewRequest builds the request message for token.
+	// Optional. Default: a *structpb.Struct {"token": token}
+	NewRequest func(token string) (interface{}, error)
+
+	// NewResponse allocates the response message.
+	// Optional. Default: a new *structpb.Struct
+	NewResponse func() interface{}
+
+	// Adapt converts the response message into a result. An inactive
+	// result is reported to the middleware as unauthorized.
+	// Optional. Default: decodes a *structpb.Struct by claim names
+	Adapt func(response interface{}) (*introspection.Result, error)
+
+	// CallOptions are passed to every call.
+	// Optional. Default: nil
+	CallOptions []grpc.CallOption
+}
+
+// Introspector introspects tokens by calling a gRPC method.
+type Introspector struct {
+	conn   grpc.ClientConnInterface
+	config Config
+}
+
+// New creates an Introspector calling config.Method on conn.
+func New(conn grpc.ClientConnInterface, config Config) *Introspector {
+	if config.NewRequest == nil {
+		config.NewRequest = structRequest
+	}
+	if config.NewResponse == nil {
+		config.NewResponse = func() interface{} { return &structpb.Struct{} }
+	}
+	if config.Adapt == nil {
+		config.Adapt = adaptStruct
+	}
+	return &Introspector{
+		conn:   conn,
+		config: config,
+	}
+}
+
+// Introspect implements introspect.Introspector.
+func (i *Introspector) Introspect(token string) (*introspection.Result, error) {
+	return i.IntrospectContext(context.Background(), token)
+}
+
+// IntrospectContext introspects token, stopping when ctx is done. The
+// Unauthenticated and PermissionDenied status codes are reported as
+// introspection.ErrUnauthorized and introspection.ErrForbidden.
+func (i *Introspector) IntrospectContext(ctx context.Context, token string) (*introspection.Result, error) {
+	request, err := i.config.NewRequest(token)
+	if err != nil {
+		return nil, err
+	}
+
+	response := i.config.NewResponse()
+	if err := i.conn.Invoke(ctx, i.config.Method, request, response, i.config.CallOptions...); err != nil {
+		switch status.Code(err) {
+		case codes.Unauthenticated:
+			return nil, introspection.ErrUnauthorized
+		case codes.PermissionDenied:
+			return nil, introspection.ErrForbidden
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	result, err := i.config.Adapt(response)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil || !result.Active {
+		return nil, introspection.ErrUnauthorized
+	}
+	return result, nil
+}
+
+func structRequest(token string) (interface{}, error) {
+	return structpb.NewStruct(map[string]interface{}{"token": token})
+}
+
+// standardClaims are the claims decoded into the fields of a result. Any
+// other claim is kept in Extra.
+var standardClaims = map[string]bool{
+	"active": true, "sub": true, "username": true, "aud": true, "token_type": true,
+	"iss": true, "client_id": true, "scope": true, "exp": true, "token_use": true,
+}
+
+func adaptStruct(response interface{}) (*introspection.Result, error) {
+	s, ok := response.(*structpb.Struct)
+	if !ok {
+		return nil, fmt.Errorf("grpcintrospect: unexpected response type %T", response)
+	}
+
+	claims := s.AsMap()
+	if aud, ok := claims["aud"].(string); ok {
+		claims["aud"] = []string{aud}
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	var result introspection.Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("%w: %v", introspect.ErrMalformedResponse, err)
+	}
+
+	for claim, value := range claims {
+		if standardClaims[claim] {
+			continue
+		}
+		if result.Extra == nil {
+			result.Extra = make(map[string]interface{})
+		}
+		result.Extra[claim] = value
+	}
+	return &result, nil
+}
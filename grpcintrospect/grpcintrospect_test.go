@@ -0,0 +1,145 @@
+package grpcintrospect
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	introspect "github.com/arsmn/fiber-introspect"
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const method = "/token.v1.TokenService/Introspect"
+
+// fakeConn answers every call to method with claims, or with err.
+type fakeConn struct {
+	claims map[string]interface{}
+	err    error
+
+	tokens []string
+}
+
+func (f *fakeConn) Invoke(ctx context.Context, m string, args, reply interface{}, _ ...grpc.CallOption) error {
+	if m != method {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", m)
+	}
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	f.tokens = append(f.tokens, args.(*structpb.Struct).GetFields()["token"].GetStringValue())
+	if f.err != nil {
+		return f.err
+	}
+
+	response, err := structpb.NewStruct(f.claims)
+	if err != nil {
+		return err
+	}
+	proto.Merge(reply.(proto.Message), response)
+	return nil
+}
+
+func (f *fakeConn) NewStream(context.Context, *grpc.StreamDesc, string, ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, status.Error(codes.Unimplemented, "streams are not supported")
+}
+
+func TestIntrospect(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+
+	tests := []struct {
+		name    string
+		conn    *fakeConn
+		want    string
+		wantErr error
+	}{
+		{"active", &fakeConn{claims: map[string]interface{}{"active": true, "sub": "alice", "aud": "api", "acr": "mfa"}}, "alice", nil},
+		{"inactive", &fakeConn{claims: map[string]interface{}{"active": false}}, "", introspection.ErrUnauthorized},
+		{"unauthenticated", &fakeConn{err: status.Error(codes.Unauthenticated, "")}, "", introspection.ErrUnauthorized},
+		{"permission denied", &fakeConn{err: status.Error(codes.PermissionDenied, "")}, "", introspection.ErrForbidden},
+		{"unavailable", &fakeConn{err: unavailable}, "", unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := New(tt.conn, Config{Method: method}).Introspect("token")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if len(tt.conn.tokens) != 1 || tt.conn.tokens[0] != "token" {
+				t.Errorf("tokens sent = %q, want [token]", tt.conn.tokens)
+			}
+			if err != nil {
+				return
+			}
+			if result.Subject != tt.want {
+				t.Errorf("sub = %q, want %q", result.Subject, tt.want)
+			}
+			if len(result.Audience) != 1 || result.Audience[0] != "api" {
+				t.Errorf("aud = %q, want [api]", result.Audience)
+			}
+			if result.Extra["acr"] != "mfa" {
+				t.Errorf("extra = %v, want acr", result.Extra)
+			}
+		})
+	}
+}
+
+func TestIntrospectContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := New(&fakeConn{}, Config{Method: method}).IntrospectContext(ctx, "token")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	now := time.Unix(1000000000, 0)
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		err    error
+		want   int
+	}{
+		{"active", map[string]interface{}{"active": true, "aud": "api", "exp": now.Add(time.Hour).Unix()}, nil, fiber.StatusOK},
+		{"expired", map[string]interface{}{"active": true, "aud": "api", "exp": now.Add(-time.Second).Unix()}, nil, fiber.StatusUnauthorized},
+		{"wrong audience", map[string]interface{}{"active": true, "aud": "other"}, nil, fiber.StatusForbidden},
+		{"inactive", map[string]interface{}{"active": false}, nil, fiber.StatusUnauthorized},
+		{"unavailable", nil, status.Error(codes.Unavailable, ""), fiber.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := introspect.Config{
+				Introspector: New(&fakeConn{claims: tt.claims, err: tt.err}, Config{Method: method}),
+				Now:          func() time.Time { return now },
+			}
+			config.Audience = []string{"api"}
+
+			app := fiber.New()
+			app.Use(introspect.New(config))
+			app.Get("/", func(c *fiber.Ctx) error {
+				return c.SendStatus(fiber.StatusOK)
+			})
+
+			req := httptest.NewRequest(fiber.MethodGet, "/", nil)
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer token")
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
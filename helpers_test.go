@@ -0,0 +1,158 @@
+package introspect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+)
+
+// testEndpoint is an introspection endpoint served by httptest. It records
+// the requests it receives, with their form parsed.
+type testEndpoint struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newTestEndpoint(t testing.TB, handler http.HandlerFunc) *testEndpoint {
+	t.Helper()
+
+	e := &testEndpoint{}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		e.mu.Lock()
+		e.requests = append(e.requests, r)
+		e.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+// config returns the introspection configuration of e.
+func (e *testEndpoint) config() introspection.Config {
+	return introspection.Config{IntrospectionURL: e.URL}
+}
+
+// calls returns the number of requests e received.
+func (e *testEndpoint) calls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.requests)
+}
+
+// last returns the last request e received.
+func (e *testEndpoint) last(t *testing.T) *http.Request {
+	t.Helper()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.requests) == 0 {
+		t.Fatal("introspection endpoint was not called")
+	}
+	return e.requests[len(e.requests)-1]
+}
+
+// respondJSON returns a handler answering every introspection with claims.
+func respondJSON(claims map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(claims)
+	}
+}
+
+// respondStatus returns a handler answering every introspection with status.
+func respondStatus(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}
+}
+
+// active returns the claims of an active token along with extra ones.
+func active(extra map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{"active": true, "sub": "alice"}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return claims
+}
+
+// newTestMiddleware creates a Middleware stopped when the test ends.
+func newTestMiddleware(t *testing.T, cfg Config) *Middleware {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	m, err := NewMiddleware(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// newTestApp mounts handler in front of a route answering 200 on any path.
+func newTestApp(handler fiber.Handler) *fiber.App {
+	app := fiber.New()
+	app.Use(handler)
+	app.All("/*", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	return app
+}
+
+// newRequest builds a GET request for path carrying token as a Bearer token,
+// unless it is empty.
+func newRequest(path, token string) *http.Request {
+	req := httptest.NewRequest(fiber.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+	return req
+}
+
+// send sends req to app and returns the response status.
+func send(t testing.TB, app *fiber.App, req *http.Request) int {
+	t.Helper()
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// requireBasicAuth returns a handler answering like next when the request
+// carries the HTTP Basic credentials id and secret, and 401 otherwise.
+func requireBasicAuth(id, secret string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if gotID, gotSecret, ok := r.BasicAuth(); !ok || gotID != id || gotSecret != secret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// eventually fails the test unless cond holds within a second, for work the
+// middleware does in the background.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,10 +1,164 @@
 package introspect
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
 	introspection "github.com/arsmn/oauth2-introspection"
-	"github.com/gofiber/fiber"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultContextKey = "user"
+	scopesKeySuffix   = "_scopes"
+)
+
+// resultKey is the context key of the result that cannot collide with
+// keys of other middleware.
+type resultKey struct{}
+
+// scopesKey is the private counterpart of ScopesContextKey.
+type scopesKey struct{}
+
+// grantedScopesKey is the context key of the scopes RequireScopes checks,
+// stored even when RedactClaims hides them.
+type grantedScopesKey struct{}
+
+// expiresKey is the context key of the exp claim RequireRemainingLifetime
+// checks, stored even when RedactClaims or ResultFields leave it out.
+type expiresKey struct{}
+
+// resultsKey is the context key of the results of Config.TokensLookup.
+type resultsKey struct{}
+
+// middlewareKey is the context key of the Middleware handling a request, so
+// that per-route handlers such as RequireScopes use its configuration.
+type middlewareKey struct{}
+
+// Events passed to Config.Logger.
+const (
+	EventIntrospect   = "introspect"
+	EventSuccess      = "success"
+	EventUnauthorized = "unauthorized"
+	EventForbidden    = "forbidden"
+	EventError        = "error"
+
+	// EventCacheError is logged when Cache fails. The request carries on
+	// as if the token was not cached, so it is not counted by Metrics.
+	EventCacheError = "cache_error"
+)
+
+// ErrMissingToken is passed to Logger when no token was found in the request.
+var ErrMissingToken = errors.New("introspect: missing token")
+
+// ErrTokenTooLong is passed to Unauthorized when a token exceeds
+// Config.MaxTokenLength.
+var ErrTokenTooLong = errors.New("introspect: token too long")
+
+// ErrClaimsValidator can be wrapped by errors returned from
+// Config.ClaimsValidator to route them to ErrorHandler instead of Forbidden.
+var ErrClaimsValidator = errors.New("introspect: claims validator failed")
+
+// ErrUnknownIssuer is passed to Logger when EndpointResolver selects no
+// known endpoint.
+var ErrUnknownIssuer = errors.New("introspect: unknown issuer")
+
+// ErrCircuitOpen is passed to ErrorHandler while the circuit breaker rejects
+// introspection calls.
+var ErrCircuitOpen = errors.New("introspect: circuit breaker is open")
+
+// ErrTimeout is passed to ErrorHandler when introspection exceeds Config.Timeout.
+var ErrTimeout = errors.New("introspect: introspection timed out")
+
+// ErrMalformedResponse is wrapped by the error passed to ErrorHandler when
+// the introspection endpoint responds with a body that is not valid JSON.
+var ErrMalformedResponse = errors.New("introspect: malformed introspection response")
+
+// ErrTokenRevoked is passed to Logger when Config.RevocationChecker reports a
+// token as revoked.
+var ErrTokenRevoked = errors.New("introspect: token revoked")
+
+// ErrRateLimited matches a *RateLimitError with errors.Is.
+var ErrRateLimited = errors.New("introspect: introspection endpoint is rate limiting")
+
+// RateLimitError is returned when the introspection endpoint responds with
+// 429 Too Many Requests.
+type RateLimitError struct {
+	// RetryAfter is the Retry-After header of the upstream response, if any.
+	RetryAfter string
+}
+
+func (e *RateLimitError) Error() string {
+	return ErrRateLimited.Error()
+}
+
+// Is reports whether target is ErrRateLimited.
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// ClientAuthMethod is the way client credentials are sent to the
+// introspection endpoint, see RFC 6749 section 2.3.1.
+type ClientAuthMethod string
+
+// Client authentication methods.
+const (
+	ClientAuthBasic ClientAuthMethod = "basic"
+	ClientAuthPost  ClientAuthMethod = "post"
 )
 
+// Introspector introspects tokens on behalf of the middleware. The default
+// is a client built from the embedded introspection.Config. Implementations
+// that also have an IntrospectContext(ctx, token) method are given the
+// request context. The middleware checks the active, exp and nbf claims of
+// every result it is given, along with the Audience and Issuers of the
+// embedded Config.
+type Introspector interface {
+	Introspect(token string) (*introspection.Result, error)
+}
+
+// IntrospectorFunc adapts a function to an Introspector.
+type IntrospectorFunc func(token string) (*introspection.Result, error)
+
+// Introspect implements Introspector.
+func (f IntrospectorFunc) Introspect(token string) (*introspection.Result, error) {
+	return f(token)
+}
+
+// contextIntrospector is implemented by introspectors able to abort a call
+// when its context is done.
+type contextIntrospector interface {
+	IntrospectContext(ctx context.Context, token string) (*introspection.Result, error)
+}
+
+// Endpoint is an introspection endpoint of Config.Endpoints or
+// Config.Fallbacks along with the client credentials it expects.
+type Endpoint struct {
+	introspection.Config
+
+	// ClientID and ClientSecret authenticate the middleware against the
+	// endpoint as set by Config.ClientAuthMethod.
+	// Optional. Default: Config.ClientID and Config.ClientSecret, unless
+	// CredentialsProvider is set
+	ClientID     string
+	ClientSecret string
+
+	// CredentialsProvider returns the client credentials for each request to
+	// the endpoint, taking precedence over ClientID and ClientSecret.
+	// Optional. Default: Config.CredentialsProvider, unless ClientID is set
+	CredentialsProvider func() (id, secret string)
+}
+
 // Config holds the configuration for the middleware
 type Config struct {
 	introspection.Config
@@ -13,118 +167,850 @@ type Config struct {
 	// Optional. Default: "Bearer"
 	AuthScheme string
 
-	// ContextKey is used to store token information into context.
+	// ContextKey is used to store token information into context. The result
+	// is also stored under a key private to this package, read by FromContext.
 	// Optional. Default: "user"
 	ContextKey string
 
+	// ScopesContextKey is used to store the parsed scopes of the token as a
+	// []string. Nothing is stored when the token has no scope claim.
+	// Optional. Default: ContextKey + "_scopes"
+	ScopesContextKey string
+
+	// ResultFields lists the claims kept in context. When set, a Fields map
+	// with only these claims is stored instead of the whole result, which
+	// FromContext converts back to a partial result.
+	// Optional. Default: nil (the whole result is stored)
+	ResultFields []string
+
+	// Transform derives the value stored under ContextKey from an authorized
+	// result, e.g. a principal with internal role names or a tenant. An error
+	// is passed to ErrorHandler. FromContext without a key still returns the
+	// result.
+	// Optional. Default: nil (the result is stored)
+	Transform func(c *fiber.Ctx, result *introspection.Result) (interface{}, error)
+
+	// ClaimsToLocals maps claim names to context keys the claims are stored
+	// under, e.g. {"sub": "user_id"}. Missing claims are not stored.
+	// Optional. Default: nil
+	ClaimsToLocals map[string]string
+
+	// StoreInUserContext also stores the result in c.UserContext(), so that
+	// code only given a context.Context can read it with ResultFromContext.
+	// Optional. Default: false
+	StoreInUserContext bool
+
+	// RedactClaims lists claims removed from the results stored in context,
+	// including ResultFields and ClaimsToLocals. Redacting "scope" also
+	// leaves ScopesContextKey unset and ScopesFromContext empty. Checks,
+	// hooks and RequireScopes still see the whole result, and cached results
+	// are not modified.
+	// Optional. Default: nil
+	RedactClaims []string
+
 	// TokenLookup is a function that is used to look up token.
 	// Optional. Default: TokenFromHeader
 	TokenLookup func(*fiber.Ctx) string
 
+	// TokensLookup looks up several tokens carried by a request, e.g. the
+	// subject and actor tokens of a delegation. When set TokenLookup is
+	// ignored and every token must pass the checks a single token would; the
+	// first one failing decides the response. Results are available with
+	// ResultsFromContext, the first one is stored as usual.
+	// Optional. Default: nil
+	TokensLookup func(*fiber.Ctx) []string
+
 	// Unauthorized defines the response body for unauthorized responses.
-	// Optional. Default: func(c *fiber.Ctx) string { c.SendStatus(401) }
-	Unauthorized func(*fiber.Ctx)
+	// The default body follows the Accept header: problem details for
+	// application/json, a page for text/html, the status text otherwise.
+	// Optional. Default: 401 with a WWW-Authenticate challenge
+	Unauthorized fiber.Handler
+
+	// ProxyAuthRequired is for forward proxies: the token is looked up in
+	// Proxy-Authorization unless TokenLookup is set, and the default
+	// Unauthorized handler sends 407 with a Proxy-Authenticate challenge.
+	// Optional. Default: false
+	ProxyAuthRequired bool
+
+	// Realm is the realm of the WWW-Authenticate challenge sent by the
+	// default Unauthorized handler.
+	// Optional. Default: ""
+	Realm string
+
+	// RealmFunc computes the realm per request, e.g. from X-Forwarded-Host,
+	// taking precedence over Realm. An empty realm is omitted.
+	// Optional. Default: nil
+	RealmFunc func(*fiber.Ctx) string
 
-	// Forbidden defines the response body for forbidden responses.
-	// Optional. Default: func(c *fiber.Ctx) string { c.SendStatus(403) }
-	Forbidden func(*fiber.Ctx)
+	// Forbidden defines the response body for forbidden responses. The
+	// default body is negotiated like the one of Unauthorized.
+	// Optional. Default: 403
+	Forbidden fiber.Handler
 
 	// ErrorHandler is a function for handling unexpected errors.
-	// Optional. Default: func(c *fiber.Ctx, err error) string { c.SendStatus(500) }
-	ErrorHandler func(*fiber.Ctx, error)
+	// Optional. Default: func(c *fiber.Ctx, err error) error { return c.SendStatus(500) }
+	ErrorHandler func(*fiber.Ctx, error) error
+
+	// UnauthorizedMessage, ForbiddenMessage and ErrorMessage are the bodies
+	// sent by the default Unauthorized, Forbidden and ErrorHandler. They are
+	// ignored by custom handlers.
+	// Optional. Default: the status text
+	UnauthorizedMessage string
+	ForbiddenMessage    string
+	ErrorMessage        string
+
+	// ContentType is sent with UnauthorizedMessage, ForbiddenMessage and
+	// ErrorMessage.
+	// Optional. Default: "text/plain"
+	ContentType string
+
+	// TreatForbiddenAsUnauthorized remaps an introspection.ErrForbidden
+	// verdict of the introspector, or of the Audience and Issuers checks of
+	// cached results, to introspection.ErrUnauthorized before it is handled.
+	// The other checks of the middleware, such as Scopes, still respond with
+	// Forbidden.
+	// Optional. Default: false
+	TreatForbiddenAsUnauthorized bool
+
+	// TreatUnauthorizedAsForbidden remaps an introspection.ErrUnauthorized
+	// verdict to introspection.ErrForbidden before it is handled. Inactive
+	// tokens are remapped too, whether they were introspected or found in
+	// the negative cache. Missing or revoked tokens and a future nbf are
+	// still unauthorized. It cannot be combined with
+	// TreatForbiddenAsUnauthorized.
+	// Optional. Default: false
+	TreatUnauthorizedAsForbidden bool
+
+	// FailOpen lets requests through without a result when the
+	// introspection endpoint cannot be reached: on network errors, timeouts,
+	// 429 responses or an open circuit breaker. The error is still passed to
+	// Logger. Handlers must check FromContext, as any token, even a forged
+	// one, passes while the endpoint is down. Verdicts, other status codes
+	// such as 401 for rejected client credentials, malformed responses,
+	// ErrSaturated, cancelled requests and failed checks are never let
+	// through. Only use it on routes that are safe to serve anonymously.
+	// Optional. Default: false
+	FailOpen bool
+
+	// ErrorMapper is consulted first for errors obtaining the introspection
+	// result, including ErrUnknownIssuer and ErrCircuitOpen. When it reports
+	// a match the returned handler is used, e.g. to answer 429 for a
+	// specific wrapped error; otherwise the built-in mapping applies.
+	// Matched errors are passed to Logger as EventError.
+	// Optional. Default: nil
+	ErrorMapper func(err error) (handler fiber.Handler, matched bool)
 
 	// SuccessHandler defines a function which is executed for a valid token.
+	// A non-nil error is returned without calling the next handler.
+	// Optional. Default: nil
+	SuccessHandler fiber.Handler
+
+	// OnSuccess is like SuccessHandler but receives the introspection result.
+	// When both are set OnSuccess is executed first.
+	// Optional. Default: nil
+	OnSuccess func(c *fiber.Ctx, result *introspection.Result) error
+
+	// After is executed once the middleware and the handlers after it have
+	// returned, whatever the decision, e.g. to emit audit events along with
+	// c.Response().StatusCode(). result is the active result, if one was
+	// obtained, and err the error passed to Logger, nil on success. Errors
+	// returned by later handlers get their status from Fiber's ErrorHandler
+	// afterwards. Requests skipped by Next, Filter, SkipPaths or SkipMethods
+	// are not passed to After.
 	// Optional. Default: nil
-	SuccessHandler func(*fiber.Ctx)
+	After func(c *fiber.Ctx, result *introspection.Result, err error)
 
-	// Filter defines a function to skip middleware.
+	// Next defines a function to skip this middleware when returned true,
+	// like in Fiber's own middleware. It is equivalent to Filter and either
+	// one returning true skips the request.
+	// Optional. Default: nil
+	Next func(c *fiber.Ctx) bool
+
+	// Filter defines a function to skip middleware. It is kept for
+	// compatibility, see Next.
 	// Optional. Default: nil
 	Filter func(*fiber.Ctx) bool
+
+	// SkipPaths lists the paths for which the middleware is skipped, e.g.
+	// "/health". An entry ending in "*", e.g. "/public/*", skips every path
+	// starting with the rest of it. Paths are compared exactly, so "/Health"
+	// and "/health/" are introspected even when the app routes them to
+	// "/health". It composes with Filter.
+	// Optional. Default: nil
+	SkipPaths []string
+
+	// SkipMethods lists request methods for which the middleware is skipped.
+	// Combined with SkipPaths, both have to match.
+	// Optional. Default: nil
+	SkipMethods []string
+
+	// Optional lets requests without a token through anonymously, storing
+	// nothing in context. Requests with a token are still fully validated.
+	// Optional. Default: false
+	Optional bool
+
+	// AllowEmptyToken passes empty tokens on to the introspector instead of
+	// responding with Unauthorized right away.
+	// Optional. Default: false
+	AllowEmptyToken bool
+
+	// MaxTokenLength is the maximum length of a token in bytes. Longer
+	// tokens are rejected with ErrTokenTooLong without being introspected.
+	// Optional. Default: 0 (no limit)
+	MaxTokenLength int
+
+	// Logger is called with one of the Event constants at each decision point.
+	// The token itself is never passed to it.
+	// Optional. Default: nil
+	Logger func(c *fiber.Ctx, event string, err error)
+
+	// Metrics records introspection outcomes and latency.
+	// Optional. Default: nil
+	Metrics Metrics
+
+	// StartSpan is used to trace obtaining the introspection result.
+	// Optional. Default: nil
+	StartSpan SpanFunc
+
+	// BeforeIntrospect is executed after TokenLookup and before the token is
+	// introspected. A non-nil error is passed to ErrorHandler.
+	// Optional. Default: nil
+	BeforeIntrospect func(c *fiber.Ctx, token string) error
+
+	// Cache is used to store active introspection results, encoded as JSON.
+	// NewMemoryCache provides an in-memory LRU and the rediscache package
+	// a cache shared between instances.
+	// Optional. Default: nil
+	Cache Cache
+
+	// CacheTimeout bounds every Cache operation. A lookup that fails or times
+	// out falls back to introspecting the token.
+	// Optional. Default: 0 (no timeout)
+	CacheTimeout time.Duration
+
+	// CacheKeySalt keys the SHA-256 HMAC tokens are hashed with before being
+	// used as cache keys, so keys cannot be correlated across processes with
+	// different salts. Raw tokens are never used as keys.
+	// Optional. Default: "" (plain SHA-256)
+	CacheKeySalt string
+
+	// CacheNamespace prefixes every cache key as "namespace:hash", so that
+	// services sharing a Cache backend do not read each other's entries.
+	// InvalidateAll then only clears the namespace, see Middleware.InvalidateAll.
+	// Optional. Default: ""
+	CacheNamespace string
+
+	// CacheTTL is the maximum duration a result is kept in Cache.
+	// Results expiring sooner are kept only until their exp claim.
+	// Optional. Default: 5 * time.Minute
+	CacheTTL time.Duration
+
+	// CacheCleanupInterval is how often expired entries are purged from
+	// caches supporting it, such as MemoryCache.
+	// Optional. Default: time.Minute
+	CacheCleanupInterval time.Duration
+
+	// DecisionCacheTTL enables an in-process cache in front of Cache that
+	// remembers, per token, method and request path, whether the token was
+	// allowed or forbidden, skipping introspection and the checks for that
+	// long. At most 64 paths are remembered per token.
+	// RevocationChecker and Transform still run for allowed tokens, and
+	// InvalidateToken drops the decisions of a token on every path. A
+	// decision outlives changes to the result until it expires, and other
+	// instances are not invalidated. Checks must depend on the token and
+	// request path only, so it cannot be combined with ScopesFunc, VerifyDPoP or
+	// VerifyCertBound.
+	// Optional. Default: 0 (disabled)
+	DecisionCacheTTL time.Duration
+
+	// DecisionCacheSize is the number of tokens the decision cache holds
+	// decisions for, evicting the least recently used ones. A negative size
+	// means no limit.
+	// Optional. Default: 10000
+	DecisionCacheSize int
+
+	// RefreshAhead is the window before a cache entry expires in which a hit
+	// triggers a background introspection of the token, so that busy tokens
+	// are not introspected on the request path. The cached result is served
+	// meanwhile. A refresh failing with a transport error leaves the entry
+	// as it is; one finding the token inactive replaces or removes it.
+	// Optional. Default: 0 (disabled)
+	RefreshAhead time.Duration
+
+	// NegativeCacheTTL is the duration inactive and unauthorized verdicts are
+	// kept in Cache, so repeated invalid tokens skip introspection. Transport
+	// errors are never cached.
+	// Optional. Default: 0 (disabled)
+	NegativeCacheTTL time.Duration
+
+	// Endpoints registers additional introspection endpoints, e.g. one per
+	// issuer in a federated setup, each with its own client credentials. It
+	// is used with EndpointResolver. Scopes of these endpoints are ignored
+	// in favor of Config.Scopes.
+	// Optional. Default: nil
+	Endpoints map[string]Endpoint
+
+	// EndpointResolver selects the key of Endpoints to introspect token
+	// against. An unknown key responds with Unauthorized.
+	// Optional. Default: nil (the embedded Config is used)
+	EndpointResolver func(c *fiber.Ctx, token string) string
+
+	// Fallbacks are introspection endpoints tried in order when the embedded
+	// one, or Introspector, fails to give a verdict, e.g. on a transport
+	// error. ErrUnauthorized and ErrForbidden are definitive and are not
+	// retried against a fallback. Endpoints are not affected. Results must
+	// still satisfy the Audience and Issuers of the embedded Config.
+	// Optional. Default: nil
+	Fallbacks []Endpoint
+
+	// Introspector is used as is to introspect tokens instead of a client
+	// built from the embedded introspection.Config, e.g. to decorate the
+	// default client or to replace it in tests. IntrospectionURL is not
+	// required when it is set. Introspectors of Endpoints are not affected.
+	// Optional. Default: nil
+	Introspector Introspector
+
+	// HTTPClient is used to call the introspection endpoint.
+	// Optional. Default: http.DefaultClient
+	HTTPClient *http.Client
+
+	// ClientID and ClientSecret authenticate the middleware against the
+	// introspection endpoint as set by ClientAuthMethod.
+	// Optional. Default: ""
+	ClientID     string
+	ClientSecret string
+
+	// ClientAuthMethod selects how client credentials are sent:
+	// ClientAuthBasic uses HTTP Basic, ClientAuthPost the form body.
+	// Optional. Default: ClientAuthBasic
+	ClientAuthMethod ClientAuthMethod
+
+	// CredentialsProvider returns the client credentials for each request to
+	// the introspection endpoint, taking precedence over ClientID and
+	// ClientSecret. It allows rotating secrets without a restart and is
+	// not called for cached results.
+	// Optional. Default: nil
+	CredentialsProvider func() (id, secret string)
+
+	// ExtraParams returns parameters added to the introspection request
+	// body, e.g. resource or tenant, evaluated for every request. Reserved
+	// parameters such as token, token_type_hint, client_id and client_secret
+	// are ignored. A cached result is only used for the parameters it was
+	// obtained with; other parameters introspect the token again and
+	// replace it, so a token has one entry for InvalidateToken to remove.
+	// Optional. Default: nil
+	ExtraParams func(c *fiber.Ctx) map[string]string
+
+	// PropagateHeaders lists headers of the incoming request, e.g.
+	// X-Request-ID, copied onto the introspection request to correlate the
+	// two. Concurrent introspections of the same token share one call, which
+	// carries the headers of the first request.
+	// Optional. Default: nil
+	PropagateHeaders []string
+
+	// TokenTypeHint is sent as token_type_hint with every introspection request,
+	// e.g. "access_token" or "refresh_token".
+	// Optional. Default: ""
+	TokenTypeHint string
+
+	// JWTVerify is an optional fast path validating self-contained tokens
+	// locally. When it returns true its result is used and remote
+	// introspection is skipped; false falls through to the introspection
+	// endpoint. A non-nil error is handled like an introspection error.
+	// The hook owns key management, while exp and nbf are checked by the
+	// middleware as for any other result.
+	// Optional. Default: nil
+	JWTVerify func(token string) (*introspection.Result, bool, error)
+
+	// AutoDetectJWT calls JWTVerify only for tokens IsJWT reports as JWTs.
+	// Opaque tokens always go to the introspection endpoint.
+	// Optional. Default: false
+	AutoDetectJWT bool
+
+	// IsJWT tells JWTs from opaque tokens when AutoDetectJWT is set.
+	// Optional. Default: IsJWT
+	IsJWT func(token string) bool
+
+	// Timeout is the maximum duration of introspecting a token, retries included.
+	// Optional. Default: 0 (no timeout)
+	Timeout time.Duration
+
+	// MaxConcurrentIntrospections bounds the number of introspection calls
+	// in flight across all endpoints. Cache hits do not count. Requests
+	// over the limit wait for a slot within Timeout and the request context.
+	// Optional. Default: 0 (no limit)
+	MaxConcurrentIntrospections int
+
+	// RejectWhenSaturated fails requests over MaxConcurrentIntrospections
+	// right away, passing ErrSaturated to ErrorHandler, instead of waiting.
+	// Optional. Default: false
+	RejectWhenSaturated bool
+
+	// MaxRetries is the number of times a failed introspection is retried.
+	// ErrUnauthorized and ErrForbidden are never retried.
+	// Optional. Default: 0
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry, doubled on each
+	// subsequent one. Retries stop once Timeout would be exceeded.
+	// Optional. Default: 100 * time.Millisecond
+	RetryBackoff time.Duration
+
+	// CircuitBreakerThreshold is the number of consecutive introspection
+	// failures that open the circuit breaker. While open, requests needing
+	// introspection fail right away with ErrCircuitOpen. Results found in
+	// the decision cache, Cache or by JWTVerify are served regardless.
+	// Optional. Default: 0 (disabled)
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerWindow is the period consecutive failures are counted in.
+	// Optional. Default: 0 (no limit)
+	CircuitBreakerWindow time.Duration
+
+	// CircuitBreakerCooldown is how long the circuit stays open before a
+	// single request is let through to test recovery.
+	// Optional. Default: 30 * time.Second
+	CircuitBreakerCooldown time.Duration
+
+	// OnCircuitOpen handles requests rejected by the open circuit breaker.
+	// Optional. Default: ErrorHandler with ErrCircuitOpen
+	OnCircuitOpen fiber.Handler
+
+	// RateLimited handles requests whose introspection was answered with
+	// 429 Too Many Requests. The upstream Retry-After header is set on the
+	// response before it is called.
+	// Optional. Default: func(c *fiber.Ctx) error { return c.SendStatus(503) }
+	RateLimited fiber.Handler
+
+	// OnMissingScopes handles tokens failing the Scopes check in place of
+	// Forbidden. missing lists the required scopes the token was not
+	// granted, e.g. to tell the client what to request.
+	// Optional. Default: nil
+	OnMissingScopes func(c *fiber.Ctx, missing []string) error
+
+	// ClockSkew is the tolerance applied when checking the nbf claim.
+	// Tokens not valid before a time later than now plus ClockSkew are
+	// unauthorized. The claim is read from Result.Extra, where the default
+	// client keeps it. A negative skew means no tolerance.
+	// Optional. Default: 5 * time.Second
+	ClockSkew time.Duration
+
+	// Now returns the current time for the exp and nbf checks of every
+	// result, whatever produced it, the DPoP iat check,
+	// RequireRemainingLifetime, the TTLs and RefreshAhead window of cached
+	// results and decisions, and the circuit breaker window and cooldown.
+	// Tests can set it to a fixed clock. Timeout, retry backoff and the
+	// expiry of entries inside a Cache such as MemoryCache follow the real
+	// clock.
+	// Optional. Default: time.Now
+	Now func() time.Time
+
+	// ScopesFunc returns the scopes required for c, e.g. built from path
+	// parameters. When set it takes precedence over Scopes, and AnyScope,
+	// ScopeStrategy and OnMissingScopes apply to its result.
+	// Optional. Default: nil
+	ScopesFunc func(c *fiber.Ctx) []string
+
+	// AnyScope grants access when any one of Scopes is granted. By default
+	// every scope in Scopes is required.
+	// Optional. Default: false
+	AnyScope bool
+
+	// RequiredAudience must be present in the aud claim of the result.
+	// Unlike Audience it is checked by the middleware, cached results included.
+	// Optional. Default: ""
+	RequiredAudience string
+
+	// AllowedIssuers lists the accepted values of the iss claim. Tokens
+	// from other issuers, or without one, are forbidden. Unlike Issuers it
+	// is checked by the middleware, cached results included.
+	// Optional. Default: nil
+	AllowedIssuers []string
+
+	// RequiredClaims maps claim names to the values they must hold.
+	// Nested claims are addressed with dotted keys such as "org.id". Values
+	// are compared in their JSON form, so numbers match regardless of their
+	// Go type and slices match arrays with the same elements in order.
+	// Optional. Default: nil
+	RequiredClaims map[string]interface{}
+
+	// VerifyDPoP checks the DPoP proof of requests whose token is bound to a
+	// key by a cnf.jkt claim (RFC 9449). The proof signature, key
+	// thumbprint, htm, htu, iat and ath are verified; a missing or invalid
+	// proof is forbidden. Proofs are not checked for replay. DPoP tokens
+	// usually come with AuthScheme "DPoP". A custom Introspector must keep
+	// the cnf claim in Result.Extra, as the default client does.
+	// Optional. Default: false
+	VerifyDPoP bool
+
+	// VerifyCertBound checks the TLS client certificate of requests whose
+	// token is bound to one by a cnf.x5t#S256 claim (RFC 8705). A missing or
+	// different certificate is forbidden. TLS must terminate at the Fiber
+	// server, as certificates forwarded by a proxy are not considered. Like
+	// VerifyDPoP, it relies on the cnf claim being kept in Result.Extra.
+	// Optional. Default: false
+	VerifyCertBound bool
+
+	// RevocationChecker is called with the jti claim of an active token,
+	// including cached ones. A revoked token routes to Unauthorized and an
+	// error to ErrorHandler. Tokens without a jti are not checked, so custom
+	// Introspectors must return it in Result.Extra.
+	// Optional. Default: nil
+	RevocationChecker func(jti string) (revoked bool, err error)
+
+	// ClaimsValidator is executed for an active token after the Scopes,
+	// RequiredAudience and RequiredClaims checks have passed. A non-nil error
+	// routes to Forbidden, or to ErrorHandler if it wraps ErrClaimsValidator.
+	// Optional. Default: nil
+	ClaimsValidator func(c *fiber.Ctx, result *introspection.Result) error
 }
 
-// New creates an introspection middleware for use in Fiber
-func New(config ...Config) func(*fiber.Ctx) {
+// New creates an introspection middleware for use in Fiber.
+// It panics if the configuration is invalid, see NewWithError.
+// Background work runs for the lifetime of the process, see NewWithContext.
+// The handler may be mounted on any number of routes; see Middleware for the
+// conditions of concurrent use.
+func New(config ...Config) fiber.Handler {
 
 	var cfg Config
 	if len(config) > 0 {
 		cfg = config[0]
 	}
 
-	if cfg.ContextKey == "" {
-		cfg.ContextKey = "user"
+	return NewWithContext(context.Background(), cfg)
+}
+
+// NewWithContext is like New but stops background work, such as purging
+// expired entries from a MemoryCache, once ctx is done.
+func NewWithContext(ctx context.Context, config Config) fiber.Handler {
+	m, err := NewMiddleware(ctx, config)
+	if err != nil {
+		panic(err)
 	}
+	return m.Handler()
+}
 
-	if cfg.AuthScheme == "" {
-		cfg.AuthScheme = "Bearer"
+// NewWithError creates an introspection middleware for use in Fiber,
+// reporting configuration problems instead of failing on every request.
+func NewWithError(config Config) (fiber.Handler, error) {
+	m, err := NewMiddleware(context.Background(), config)
+	if err != nil {
+		return nil, err
 	}
+	return m.Handler(), nil
+}
 
-	if cfg.Unauthorized == nil {
-		cfg.Unauthorized = func(c *fiber.Ctx) {
-			c.SendStatus(fiber.StatusUnauthorized)
+// validateConfig checks the introspection endpoints of cfg.
+func validateConfig(cfg Config) error {
+	if (cfg.EndpointResolver == nil && cfg.Introspector == nil) || cfg.IntrospectionURL != "" {
+		if err := validateEndpoint("Config", cfg.Config); err != nil {
+			return err
 		}
 	}
 
-	if cfg.Forbidden == nil {
-		cfg.Forbidden = func(c *fiber.Ctx) {
-			c.SendStatus(fiber.StatusForbidden)
+	switch cfg.ClientAuthMethod {
+	case "", ClientAuthBasic, ClientAuthPost:
+	default:
+		return fmt.Errorf("introspect: unknown ClientAuthMethod %q", cfg.ClientAuthMethod)
+	}
+
+	if cfg.DecisionCacheTTL > 0 {
+		switch {
+		case cfg.ScopesFunc != nil:
+			return errors.New("introspect: DecisionCacheTTL cannot be combined with ScopesFunc")
+		case cfg.VerifyDPoP:
+			return errors.New("introspect: DecisionCacheTTL cannot be combined with VerifyDPoP")
+		case cfg.VerifyCertBound:
+			return errors.New("introspect: DecisionCacheTTL cannot be combined with VerifyCertBound")
 		}
 	}
 
-	if cfg.ErrorHandler == nil {
-		cfg.ErrorHandler = func(c *fiber.Ctx, err error) {
-			c.SendStatus(fiber.StatusInternalServerError)
+	if cfg.TreatForbiddenAsUnauthorized && cfg.TreatUnauthorizedAsForbidden {
+		return errors.New("introspect: TreatForbiddenAsUnauthorized and TreatUnauthorizedAsForbidden are mutually exclusive")
+	}
+
+	if cfg.EndpointResolver != nil && len(cfg.Endpoints) == 0 {
+		return errors.New("introspect: EndpointResolver is set but Endpoints is empty")
+	}
+
+	for name, endpoint := range cfg.Endpoints {
+		if err := validateEndpoint(fmt.Sprintf("Endpoints[%q]", name), endpoint.Config); err != nil {
+			return err
 		}
 	}
 
-	if cfg.TokenLookup == nil {
-		cfg.TokenLookup = TokenFromHeader(fiber.HeaderAuthorization, cfg.AuthScheme)
+	for n, endpoint := range cfg.Fallbacks {
+		if err := validateEndpoint(fmt.Sprintf("Fallbacks[%d]", n), endpoint.Config); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateEndpoint(field string, config introspection.Config) error {
+	if config.IntrospectionURL == "" {
+		return fmt.Errorf("introspect: %s.IntrospectionURL is required", field)
+	}
+
+	u, err := url.Parse(config.IntrospectionURL)
+	if err != nil {
+		return fmt.Errorf("introspect: %s.IntrospectionURL is invalid: %w", field, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("introspect: %s.IntrospectionURL must be an absolute http(s) URL", field)
 	}
 
-	var introspector = introspection.New(cfg.Config)
-	return func(c *fiber.Ctx) {
+	return nil
+}
 
-		if cfg.Filter != nil && cfg.Filter(c) {
-			c.Next()
-			return
+// introspectContext calls i with ctx. Introspectors not accepting a context
+// are abandoned when ctx is done and left to finish in the background.
+func introspectContext(ctx context.Context, i Introspector, token string) (*introspection.Result, error) {
+	if ci, ok := i.(contextIntrospector); ok {
+		result, err := ci.IntrospectContext(ctx, token)
+		if err != nil && ctx.Err() != nil {
+			return nil, contextError(ctx)
 		}
+		return result, err
+	}
 
-		token := cfg.TokenLookup(c)
-		result, err := introspector.Introspect(token)
+	if ctx.Done() == nil {
+		return i.Introspect(token)
+	}
 
-		if err != nil {
-			switch err {
-			case introspection.ErrUnauthorized:
-				cfg.Unauthorized(c)
-			case introspection.ErrForbidden:
-				cfg.Forbidden(c)
-			default:
-				cfg.ErrorHandler(c, err)
-			}
-			return
+	type response struct {
+		result *introspection.Result
+		err    error
+	}
+
+	done := make(chan response, 1)
+	go func() {
+		result, err := i.Introspect(token)
+		done <- response{result, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.result, r.err
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	}
+}
+
+// introspectWithRetry retries transient failures with exponential backoff,
+// keeping the whole attempt within cfg.Timeout when one is set.
+func introspectWithRetry(ctx context.Context, i Introspector, token string, cfg Config) (*introspection.Result, error) {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	backoff := cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		result, err := introspectContext(ctx, i, token)
+		switch err {
+		case nil, introspection.ErrUnauthorized, introspection.ErrForbidden:
+			return result, err
 		}
 
-		c.Locals(cfg.ContextKey, result)
+		// Retrying would only add to the load of the endpoint.
+		if errors.Is(err, ErrRateLimited) || err == ErrSaturated {
+			return result, err
+		}
+
+		if ctx.Err() != nil || attempt >= cfg.MaxRetries {
+			return result, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return result, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, contextError(ctx)
+		}
+		backoff *= 2
+	}
+}
+
+// introspectShared collapses concurrent introspections of key into one call
+// governed by the context of the first caller. Every caller stops waiting
+// when its own ctx is done, and a caller whose leader was cancelled retries
+// on its own. done is called with the outcome of each call made, not once
+// per caller.
+func introspectShared(ctx context.Context, group *singleflight.Group, key string, i Introspector, token string, cfg Config,
+	done func(error)) (*introspection.Result, error) {
+	call := func() (*introspection.Result, error) {
+		result, err := introspectWithRetry(ctx, i, token, cfg)
+		done(err)
+		return result, err
+	}
+
+	ch := group.DoChan(key, func() (interface{}, error) {
+		return call()
+	})
+
+	select {
+	case r := <-ch:
+		if r.Err == context.Canceled && ctx.Err() == nil {
+			return call()
+		}
+		result, _ := r.Val.(*introspection.Result)
+		return result, r.Err
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	}
+}
+
+// contextError maps the error of a done ctx, reporting deadlines as ErrTimeout.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+// FromContext returns the introspection result stored by the middleware.
+// Without a key it reads the collision-free key private to this package,
+// which is set whatever ContextKey is configured. A key reads that
+// ContextKey instead.
+func FromContext(c *fiber.Ctx, key ...string) (*introspection.Result, bool) {
+	var k interface{} = resultKey{}
+	if len(key) > 0 && key[0] != "" {
+		k = key[0]
+	}
+	switch v := c.Locals(k).(type) {
+	case *introspection.Result:
+		return v, v != nil
+	case Fields:
+		return v.Result(), true
+	}
+	return nil, false
+}
+
+// ResultFromContext returns the introspection result stored in the user
+// context of the request with Config.StoreInUserContext, or in any context
+// derived from it.
+func ResultFromContext(ctx context.Context) (*introspection.Result, bool) {
+	switch v := ctx.Value(resultKey{}).(type) {
+	case *introspection.Result:
+		return v, v != nil
+	case Fields:
+		return v.Result(), true
+	}
+	return nil, false
+}
+
+// ResultsFromContext returns the introspection results of the tokens found
+// by Config.TokensLookup, in lookup order, with RedactClaims and
+// ResultFields applied as for FromContext. It returns nil outside of
+// multi-token mode.
+func ResultsFromContext(c *fiber.Ctx) []*introspection.Result {
+	results, _ := c.Locals(resultsKey{}).([]*introspection.Result)
+	return results
+}
+
+// IsJWT reports whether token is shaped like a JWT in compact serialization:
+// three dot-separated base64url segments, the first two non-empty, with a
+// header decoding to a JSON object. The signature is not verified.
+func IsJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return false
+	}
 
-		if cfg.SuccessHandler != nil {
-			cfg.SuccessHandler(c)
+	for _, part := range parts {
+		if strings.IndexFunc(part, func(r rune) bool {
+			return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+		}) >= 0 {
+			return false
 		}
+	}
 
-		c.Next()
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
 	}
+	var fields map[string]interface{}
+	return json.Unmarshal(header, &fields) == nil
 }
 
 // TokenFromHeader returns a function that extracts token from the request header.
+// The scheme is matched case-insensitively and may be separated from the token
+// by any run of spaces or tabs. An empty scheme returns the whole header value.
 func TokenFromHeader(header string, authScheme string) func(*fiber.Ctx) string {
+	if authScheme == "" {
+		return TokenFromHeaderRaw(header)
+	}
 	return func(c *fiber.Ctx) string {
-		auth := c.Get(header)
+		auth := strings.TrimSpace(c.Get(header))
 		l := len(authScheme)
-		if len(auth) > l+1 && auth[:l] == authScheme {
-			return auth[l+1:]
+		if len(auth) > l && (auth[l] == ' ' || auth[l] == '\t') && strings.EqualFold(auth[:l], authScheme) {
+			return strings.TrimSpace(auth[l:])
 		}
 		return ""
 	}
 }
 
+// TokenFromBearer returns a function that extracts the RFC 6750 b64token
+// of a Bearer Authorization header, ignoring parameters following it, e.g.
+// "Bearer <token>, SignatureAlg=ES256". Tokens containing characters outside
+// the b64token syntax are not extracted.
+func TokenFromBearer() func(*fiber.Ctx) string {
+	lookup := TokenFromHeader(fiber.HeaderAuthorization, "Bearer")
+	return func(c *fiber.Ctx) string {
+		token := lookup(c)
+		end := strings.IndexFunc(token, func(r rune) bool {
+			return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' ||
+				r == '-' || r == '.' || r == '_' || r == '~' || r == '+' || r == '/' || r == '=')
+		})
+		if end < 0 {
+			end = len(token)
+		} else if token[end] != ',' && token[end] != ' ' && token[end] != '\t' {
+			return ""
+		}
+
+		token = token[:end]
+		// Padding may only end the token.
+		if trimmed := strings.TrimRight(token, "="); strings.Contains(trimmed, "=") || trimmed == "" {
+			return ""
+		}
+		return token
+	}
+}
+
+// TokenFromHeaderRaw returns a function that extracts token from the request
+// header as is, without a scheme.
+func TokenFromHeaderRaw(header string) func(*fiber.Ctx) string {
+	return func(c *fiber.Ctx) string {
+		return strings.TrimSpace(c.Get(header))
+	}
+}
+
+// MultiTokenLookup returns a function that tries each extractor in order
+// and returns the first non-empty token. It can be used as Config.TokenLookup.
+func MultiTokenLookup(extractors ...func(*fiber.Ctx) string) func(*fiber.Ctx) string {
+	return func(c *fiber.Ctx) string {
+		for _, extractor := range extractors {
+			if token := extractor(c); token != "" {
+				return token
+			}
+		}
+		return ""
+	}
+}
+
+// TokenFromProxyAuthorization returns a function that extracts token from the
+// Proxy-Authorization header, see TokenFromHeader.
+func TokenFromProxyAuthorization(scheme string) func(*fiber.Ctx) string {
+	return TokenFromHeader(fiber.HeaderProxyAuthorization, scheme)
+}
+
 // TokenFromQuery returns a function that extracts token from the query string.
 func TokenFromQuery(param string) func(*fiber.Ctx) string {
 	return func(c *fiber.Ctx) string {
@@ -145,3 +1031,102 @@ func TokenFromCookie(name string) func(*fiber.Ctx) string {
 		return c.Cookies(name)
 	}
 }
+
+// TokenFromCookieSigned returns a function that extracts token from the named
+// cookie after verifying its signature. The cookie value has the form
+// "<token>.<signature>", where signature is the unpadded base64url encoding of
+// HMAC-SHA256(secret, token). An invalid signature yields an empty token.
+func TokenFromCookieSigned(name, secret string) func(*fiber.Ctx) string {
+	key := []byte(secret)
+	return func(c *fiber.Ctx) string {
+		value := c.Cookies(name)
+		i := strings.LastIndexByte(value, '.')
+		if i <= 0 {
+			return ""
+		}
+
+		token, signature := value[:i], value[i+1:]
+		got, err := base64.RawURLEncoding.DecodeString(signature)
+		if err != nil {
+			return ""
+		}
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(token))
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			return ""
+		}
+		return token
+	}
+}
+
+// TokenFromJSON returns a function that extracts token from a string field
+// of a JSON body, addressed by a dotted path such as "auth.token". Fiber
+// buffers the body, so later handlers can still read it. Bodies that are
+// not JSON objects yield an empty token.
+func TokenFromJSON(path string) func(*fiber.Ctx) string {
+	return func(c *fiber.Ctx) string {
+		body := c.Body()
+		if len(body) == 0 {
+			return ""
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return ""
+		}
+
+		token, _ := lookupClaim(fields, path)
+		s, _ := token.(string)
+		return s
+	}
+}
+
+// TokenFromWebSocketProtocol returns a function that extracts token from the
+// comma-separated Sec-WebSocket-Protocol header. The token is either the
+// remainder of an entry starting with prefix, e.g. "access_token.<token>" for
+// the prefix "access_token.", or the entry following one equal to prefix.
+// The upgrade response still has to select one of the offered protocols.
+func TokenFromWebSocketProtocol(prefix string) func(*fiber.Ctx) string {
+	return func(c *fiber.Ctx) string {
+		entries := strings.Split(c.Get(fiber.HeaderSecWebSocketProtocol), ",")
+		for i, entry := range entries {
+			entry = strings.TrimSpace(entry)
+			switch {
+			case entry == prefix && i+1 < len(entries):
+				return strings.TrimSpace(entries[i+1])
+			case prefix != "" && len(entry) > len(prefix) && strings.HasPrefix(entry, prefix):
+				return entry[len(prefix):]
+			}
+		}
+		return ""
+	}
+}
+
+// TokenFromForm returns a function that extracts token from the form body.
+func TokenFromForm(param string) func(*fiber.Ctx) string {
+	return func(c *fiber.Ctx) string {
+		return c.FormValue(param)
+	}
+}
+
+// TokenFromMultipart returns a function that extracts token from a field of a
+// multipart/form-data body. The parsed form is kept on the request, so
+// handlers can still read the uploaded files with c.FormFile or
+// c.MultipartForm afterwards. Other requests yield an empty token.
+func TokenFromMultipart(field string) func(*fiber.Ctx) string {
+	return func(c *fiber.Ctx) string {
+		if !strings.HasPrefix(strings.ToLower(c.Get(fiber.HeaderContentType)), fiber.MIMEMultipartForm) {
+			return ""
+		}
+
+		form, err := c.MultipartForm()
+		if err != nil {
+			return ""
+		}
+		if values := form.Value[field]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+}
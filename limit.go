@@ -0,0 +1,62 @@
+package introspect
+
+import (
+	"context"
+	"errors"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"golang.org/x/sync/semaphore"
+)
+
+// ErrSaturated is passed to ErrorHandler when MaxConcurrentIntrospections
+// calls are in flight and RejectWhenSaturated is set.
+var ErrSaturated = errors.New("introspect: too many concurrent introspections")
+
+// limitedIntrospector bounds the number of in-flight calls to introspector
+// with a semaphore shared by every endpoint of a Middleware.
+type limitedIntrospector struct {
+	introspector Introspector
+	sem          *semaphore.Weighted
+	reject       bool
+}
+
+// Introspect implements Introspector.
+func (l *limitedIntrospector) Introspect(token string) (*introspection.Result, error) {
+	return l.IntrospectContext(context.Background(), token)
+}
+
+// IntrospectContext implements contextIntrospector. The slot is held until
+// the underlying call returns, even when ctx is done before.
+func (l *limitedIntrospector) IntrospectContext(ctx context.Context, token string) (*introspection.Result, error) {
+	if l.reject {
+		if !l.sem.TryAcquire(1) {
+			return nil, ErrSaturated
+		}
+	} else if err := l.sem.Acquire(ctx, 1); err != nil {
+		return nil, contextError(ctx)
+	}
+
+	if _, ok := l.introspector.(contextIntrospector); ok {
+		defer l.sem.Release(1)
+		return introspectContext(ctx, l.introspector, token)
+	}
+
+	type response struct {
+		result *introspection.Result
+		err    error
+	}
+
+	done := make(chan response, 1)
+	go func() {
+		defer l.sem.Release(1)
+		result, err := l.introspector.Introspect(token)
+		done <- response{result, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.result, r.err
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	}
+}
@@ -0,0 +1,124 @@
+package introspect
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// gatedEndpoint answers active once release is closed, recording the
+// highest number of calls it held at once.
+func gatedEndpoint(t *testing.T, release <-chan struct{}) (*testEndpoint, func() int) {
+	var (
+		mu            sync.Mutex
+		inFlight, max int
+	)
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if inFlight++; inFlight > max {
+			max = inFlight
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		respondJSON(active(nil))(w, r)
+	})
+	return e, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return max
+	}
+}
+
+func TestMaxConcurrentIntrospections(t *testing.T) {
+	release := make(chan struct{})
+	e, max := gatedEndpoint(t, release)
+	app := newTestApp(New(Config{Config: e.config(), MaxConcurrentIntrospections: 2}))
+
+	const requests = 5
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func(token string) {
+			resp, err := app.Test(newRequest("/", token), -1)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}("token-" + strconv.Itoa(i))
+	}
+
+	eventually(t, "two calls in flight", func() bool { return e.calls() == 2 })
+	time.Sleep(20 * time.Millisecond)
+	if e.calls() != 2 {
+		t.Errorf("%d calls in flight, want 2", e.calls())
+	}
+	close(release)
+
+	for i := 0; i < requests; i++ {
+		if got := <-statuses; got != fiber.StatusOK {
+			t.Errorf("status = %d, want %d", got, fiber.StatusOK)
+		}
+	}
+	if got := max(); got != 2 {
+		t.Errorf("at most %d calls in flight, want 2", got)
+	}
+	if e.calls() != requests {
+		t.Errorf("endpoint called %d times, want %d", e.calls(), requests)
+	}
+}
+
+func TestRejectWhenSaturated(t *testing.T) {
+	release := make(chan struct{})
+	e, _ := gatedEndpoint(t, release)
+
+	var rejected error
+	app := newTestApp(New(Config{
+		Config:                      e.config(),
+		MaxConcurrentIntrospections: 1,
+		RejectWhenSaturated:         true,
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			rejected = err
+			return c.SendStatus(fiber.StatusServiceUnavailable)
+		},
+	}))
+
+	first := make(chan int, 1)
+	go func() {
+		resp, err := app.Test(newRequest("/", "first"), -1)
+		if err != nil {
+			first <- 0
+			return
+		}
+		resp.Body.Close()
+		first <- resp.StatusCode
+	}()
+	eventually(t, "the first call", func() bool { return e.calls() == 1 })
+
+	if got := send(t, app, newRequest("/", "second")); got != fiber.StatusServiceUnavailable {
+		t.Errorf("saturated: status = %d, want %d", got, fiber.StatusServiceUnavailable)
+	}
+	if rejected != ErrSaturated {
+		t.Errorf("saturated: err = %v, want %v", rejected, ErrSaturated)
+	}
+
+	close(release)
+	if got := <-first; got != fiber.StatusOK {
+		t.Errorf("first: status = %d, want %d", got, fiber.StatusOK)
+	}
+	if got := send(t, app, newRequest("/", "third")); got != fiber.StatusOK {
+		t.Errorf("after release: status = %d, want %d", got, fiber.StatusOK)
+	}
+	if e.calls() != 2 {
+		t.Errorf("endpoint called %d times, want 2", e.calls())
+	}
+}
@@ -0,0 +1,172 @@
+package introspect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics records introspection outcomes. It can be backed by Prometheus or
+// any other metrics library without the middleware depending on it.
+type Metrics interface {
+	// Count is called once per request with EventSuccess, EventUnauthorized,
+	// EventForbidden or EventError.
+	Count(event string)
+
+	// ObserveLatency is called with the duration of each remote introspection.
+	ObserveLatency(d time.Duration)
+}
+
+// LabeledMetrics is a Metrics also told where a success came from and why a
+// request failed. When implemented CountLabeled is called instead of Count.
+type LabeledMetrics interface {
+	Metrics
+
+	// CountLabeled is called like Count along with the labels of the event.
+	CountLabeled(event string, labels Labels)
+}
+
+// Labels qualify the events passed to LabeledMetrics. Their values are
+// limited to the Source and Reason constants so that cardinality stays
+// bounded.
+type Labels struct {
+	// Source is set for EventSuccess.
+	Source string
+
+	// Reason is set for EventUnauthorized and EventError when the
+	// introspection endpoint is the cause, empty otherwise.
+	Reason string
+}
+
+// Values of Labels.Source.
+const (
+	SourceCache  = "cache"
+	SourceRemote = "remote"
+	SourceLocal  = "local"
+)
+
+// Values of Labels.Reason.
+const (
+	ReasonInactive  = "inactive"
+	ReasonTransport = "transport"
+	ReasonTimeout   = "timeout"
+	ReasonMalformed = "malformed"
+)
+
+// failureReason classifies an error obtaining an introspection result. JSON
+// errors of custom introspectors count as malformed responses, like the
+// ErrMalformedResponse of the default client.
+func failureReason(err error) string {
+	var (
+		syntax    *json.SyntaxError
+		unmarshal *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return ReasonTimeout
+	case errors.Is(err, ErrMalformedResponse), errors.As(err, &syntax), errors.As(err, &unmarshal):
+		return ReasonMalformed
+	}
+	return ReasonTransport
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Count(string)                 {}
+func (nopMetrics) ObserveLatency(time.Duration) {}
+
+// Stats is a snapshot of the cumulative counters of a Middleware.
+type Stats struct {
+	// Requests is the number of requests the middleware authenticated,
+	// skipped requests excluded.
+	Requests uint64
+
+	// CacheHits and CacheMisses count Cache lookups.
+	CacheHits   uint64
+	CacheMisses uint64
+
+	// DecisionHits and DecisionMisses count decision cache lookups. A
+	// decision hit skips the Cache lookup.
+	DecisionHits   uint64
+	DecisionMisses uint64
+
+	// Introspections is the number of remote introspection calls.
+	Introspections uint64
+
+	// Success, Unauthorized, Forbidden and Errors count the outcomes of
+	// requests like the events passed to Metrics.Count.
+	Success      uint64
+	Unauthorized uint64
+	Forbidden    uint64
+	Errors       uint64
+}
+
+type counters struct {
+	requests       atomic.Uint64
+	cacheHits      atomic.Uint64
+	cacheMisses    atomic.Uint64
+	decisionHits   atomic.Uint64
+	decisionMisses atomic.Uint64
+	introspections atomic.Uint64
+	success        atomic.Uint64
+	unauthorized   atomic.Uint64
+	forbidden      atomic.Uint64
+	errors         atomic.Uint64
+}
+
+func (c *counters) event(event string) {
+	switch event {
+	case EventIntrospect:
+		c.introspections.Add(1)
+	case EventSuccess:
+		c.success.Add(1)
+	case EventUnauthorized:
+		c.unauthorized.Add(1)
+	case EventForbidden:
+		c.forbidden.Add(1)
+	case EventError:
+		c.errors.Add(1)
+	}
+}
+
+func (c *counters) cache(hit bool) {
+	if hit {
+		c.cacheHits.Add(1)
+	} else {
+		c.cacheMisses.Add(1)
+	}
+}
+
+func (c *counters) decision(hit bool) {
+	if hit {
+		c.decisionHits.Add(1)
+	} else {
+		c.decisionMisses.Add(1)
+	}
+}
+
+func (c *counters) load() Stats {
+	return Stats{
+		Requests:       c.requests.Load(),
+		CacheHits:      c.cacheHits.Load(),
+		CacheMisses:    c.cacheMisses.Load(),
+		DecisionHits:   c.decisionHits.Load(),
+		DecisionMisses: c.decisionMisses.Load(),
+		Introspections: c.introspections.Load(),
+		Success:        c.success.Load(),
+		Unauthorized:   c.unauthorized.Load(),
+		Forbidden:      c.forbidden.Load(),
+		Errors:         c.errors.Load(),
+	}
+}
+
+func (c *counters) reset() {
+	for _, v := range []*atomic.Uint64{
+		&c.requests, &c.cacheHits, &c.cacheMisses, &c.decisionHits, &c.decisionMisses, &c.introspections,
+		&c.success, &c.unauthorized, &c.forbidden, &c.errors,
+	} {
+		v.Store(0)
+	}
+}
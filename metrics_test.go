@@ -0,0 +1,166 @@
+package introspect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+)
+
+func TestFailureReason(t *testing.T) {
+	syntax := json.Unmarshal([]byte("not-json"), new(interface{}))
+	unmarshal := json.Unmarshal([]byte(`{"active":"yes"}`), new(struct{ Active bool }))
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{ErrTimeout, ReasonTimeout},
+		{fmt.Errorf("%w: unexpected end of JSON input", ErrMalformedResponse), ReasonMalformed},
+		{syntax, ReasonMalformed},
+		{fmt.Errorf("decode: %w", unmarshal), ReasonMalformed},
+		{errors.New("connection refused"), ReasonTransport},
+	}
+	for _, tt := range tests {
+		if got := failureReason(tt.err); got != tt.want {
+			t.Errorf("failureReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// recordingMetrics records what the middleware reports to Metrics.
+type recordingMetrics struct {
+	mu        sync.Mutex
+	events    []string
+	latencies int
+}
+
+func (r *recordingMetrics) Count(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recordingMetrics) ObserveLatency(time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies++
+}
+
+// recordingLabeledMetrics also records the labels of every event, with
+// events counted without labels recorded as "unlabeled".
+type recordingLabeledMetrics struct {
+	recordingMetrics
+	labels []Labels
+}
+
+func (r *recordingLabeledMetrics) Count(string) {
+	r.recordingMetrics.Count("unlabeled")
+}
+
+func (r *recordingLabeledMetrics) CountLabeled(event string, labels Labels) {
+	r.recordingMetrics.Count(event)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.labels = append(r.labels, labels)
+}
+
+func TestMetrics(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		switch token := r.PostForm.Get("token"); token {
+		case "down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "inactive":
+			respondJSON(map[string]interface{}{"active": false})(w, r)
+		default:
+			respondJSON(active(map[string]interface{}{"scope": token}))(w, r)
+		}
+	})
+
+	metrics := &recordingMetrics{}
+	config := e.config()
+	config.Scopes = []string{"read"}
+	app := newTestApp(New(Config{Config: config, Cache: NewMemoryCache(0), Metrics: metrics}))
+
+	for _, token := range []string{"read", "read", "write", "inactive", "down"} {
+		send(t, app, newRequest("/", token))
+	}
+
+	want := []string{EventSuccess, EventSuccess, EventForbidden, EventUnauthorized, EventError}
+	if !reflect.DeepEqual(metrics.events, want) {
+		t.Errorf("events = %q, want %q", metrics.events, want)
+	}
+	// The second request is served from the cache.
+	if metrics.latencies != 4 {
+		t.Errorf("latency observed %d times, want 4", metrics.latencies)
+	}
+}
+
+func TestLabeledMetrics(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.PostForm.Get("token") {
+		case "down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "malformed":
+			_, _ = w.Write([]byte("not-json"))
+		case "inactive":
+			respondJSON(map[string]interface{}{"active": false})(w, r)
+		default:
+			respondJSON(active(nil))(w, r)
+		}
+	})
+
+	metrics := &recordingLabeledMetrics{}
+	m := newTestMiddleware(t, Config{
+		Config:  e.config(),
+		Cache:   NewMemoryCache(0),
+		Metrics: metrics,
+		JWTVerify: func(token string) (*introspection.Result, bool, error) {
+			return &introspection.Result{Active: true}, token == "local", nil
+		},
+	})
+	app := newTestApp(m.Handler())
+
+	for _, token := range []string{"token", "token", "local", "inactive", "down", "malformed"} {
+		send(t, app, newRequest("/", token))
+	}
+
+	wantEvents := []string{EventSuccess, EventSuccess, EventSuccess, EventUnauthorized, EventError, EventError}
+	if !reflect.DeepEqual(metrics.events, wantEvents) {
+		t.Errorf("events = %q, want %q", metrics.events, wantEvents)
+	}
+	wantLabels := []Labels{
+		{Source: SourceRemote},
+		{Source: SourceCache},
+		{Source: SourceLocal},
+		{Reason: ReasonInactive},
+		{Reason: ReasonTransport},
+		{Reason: ReasonMalformed},
+	}
+	if !reflect.DeepEqual(metrics.labels, wantLabels) {
+		t.Errorf("labels = %+v, want %+v", metrics.labels, wantLabels)
+	}
+
+	wantStats := Stats{
+		Requests:       6,
+		CacheHits:      1,
+		CacheMisses:    5,
+		Introspections: 4,
+		Success:        3,
+		Unauthorized:   1,
+		Errors:         2,
+	}
+	if got := m.Stats(); got != wantStats {
+		t.Errorf("stats = %+v, want %+v", got, wantStats)
+	}
+	m.ResetStats()
+	if got := m.Stats(); got != (Stats{}) {
+		t.Errorf("stats after reset = %+v, want zero", got)
+	}
+}
@@ -0,0 +1,1070 @@
+package introspect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrNoCache is returned by Prewarm when Config.Cache is not set.
+var ErrNoCache = errors.New("introspect: no cache configured")
+
+// ErrCacheNotClearable is returned by InvalidateAll when Config.Cache cannot
+// remove all of its entries, or those of the CacheNamespace.
+var ErrCacheNotClearable = errors.New("introspect: cache cannot be cleared")
+
+// Middleware holds the state shared by all requests handled by the
+// introspection middleware. It is safe for concurrent use provided that:
+//
+//   - the Config it was created with, including the slices and maps it
+//     holds, is not modified afterwards;
+//   - hooks such as Logger, Metrics, TokenLookup or ClaimsValidator, and
+//     custom Cache and Introspector implementations, are safe to call from
+//     several goroutines;
+//   - results are treated as read-only, since concurrent requests with the
+//     same token share the result of a single introspection call.
+type Middleware struct {
+	cfg          Config
+	introspector Introspector
+	endpoints    map[string]Introspector
+	unauthorized func(*fiber.Ctx, error) error
+	circuit      *breaker
+	decisions    *decisionCache
+	stats        counters
+
+	// primary and probes are the introspectors of the embedded Config and
+	// of Endpoints as HealthCheck probes them, without the Fallbacks and
+	// the MaxConcurrentIntrospections limit.
+	primary Introspector
+	probes  map[string]Introspector
+
+	// Concurrent introspections of the same token share a single call.
+	group singleflight.Group
+
+	// Background refreshes of the same cache entry share a single call.
+	refreshes singleflight.Group
+}
+
+// NewMiddleware creates a Middleware. Background work, such as purging
+// expired entries from a MemoryCache, stops once ctx is done.
+func NewMiddleware(ctx context.Context, config Config) (*Middleware, error) {
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	return newMiddleware(ctx, config), nil
+}
+
+// NewTestMiddleware creates a middleware answering every token with result
+// and err instead of calling an introspection endpoint, for testing the
+// handlers behind it. A nil err with an inactive or nil result is
+// unauthorized, like ErrUnauthorized.
+func NewTestMiddleware(result *introspection.Result, err error) fiber.Handler {
+	return newMiddleware(context.Background(), Config{
+		Introspector: IntrospectorFunc(func(string) (*introspection.Result, error) {
+			return result, err
+		}),
+	}).Handler()
+}
+
+// newMiddleware applies the defaults to a validated config.
+func newMiddleware(ctx context.Context, config Config) *Middleware {
+	cfg := config
+
+	if cfg.ContextKey == "" {
+		cfg.ContextKey = defaultContextKey
+	}
+
+	if cfg.ScopesContextKey == "" {
+		cfg.ScopesContextKey = cfg.ContextKey + scopesKeySuffix
+	}
+
+	if cfg.AuthScheme == "" {
+		cfg.AuthScheme = "Bearer"
+	}
+
+	if cfg.ContentType == "" {
+		cfg.ContentType = fiber.MIMETextPlain
+	}
+
+	if cfg.Forbidden == nil {
+		cfg.Forbidden = func(c *fiber.Ctx) error {
+			return negotiate(c, fiber.StatusForbidden, forbiddenDetail, cfg.ForbiddenMessage, cfg.ContentType)
+		}
+	}
+
+	if cfg.ErrorHandler == nil {
+		cfg.ErrorHandler = func(c *fiber.Ctx, err error) error {
+			return sendStatus(c, fiber.StatusInternalServerError, cfg.ErrorMessage, cfg.ContentType)
+		}
+	}
+
+	if cfg.TokenLookup == nil && cfg.ProxyAuthRequired {
+		cfg.TokenLookup = TokenFromProxyAuthorization(cfg.AuthScheme)
+	}
+
+	if cfg.TokenLookup == nil {
+		cfg.TokenLookup = TokenFromHeader(fiber.HeaderAuthorization, cfg.AuthScheme)
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = func(*fiber.Ctx, string, error) {}
+	}
+
+	if cfg.Metrics == nil {
+		cfg.Metrics = nopMetrics{}
+	}
+
+	if cfg.IsJWT == nil {
+		cfg.IsJWT = IsJWT
+	}
+
+	if cfg.StartSpan == nil {
+		cfg.StartSpan = nopSpan
+	}
+
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = 5 * time.Minute
+	}
+
+	if cfg.CacheCleanupInterval == 0 {
+		cfg.CacheCleanupInterval = time.Minute
+	}
+
+	if cfg.DecisionCacheSize == 0 {
+		cfg.DecisionCacheSize = 10000
+	}
+
+	if len(cfg.RequiredClaims) > 0 {
+		cfg.RequiredClaims = normalizeClaims(cfg.RequiredClaims)
+	}
+
+	if cfg.ClockSkew == 0 {
+		cfg.ClockSkew = 5 * time.Second
+	} else if cfg.ClockSkew < 0 {
+		cfg.ClockSkew = 0
+	}
+
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	if cfg.CircuitBreakerCooldown == 0 {
+		cfg.CircuitBreakerCooldown = 30 * time.Second
+	}
+
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+
+	// Scopes are enforced by the middleware so that AnyScope applies
+	// to cached results as well.
+	var introspectionConfig = cfg.Config
+	introspectionConfig.Scopes = nil
+
+	defaultIntrospector := cfg.Introspector
+	if defaultIntrospector == nil {
+		defaultIntrospector = newIntrospector(cfg, Endpoint{Config: introspectionConfig})
+	}
+
+	primary := defaultIntrospector
+
+	if len(cfg.Fallbacks) > 0 {
+		chain := fallbackIntrospector{defaultIntrospector}
+		for _, endpoint := range cfg.Fallbacks {
+			endpoint.Scopes = nil
+			chain = append(chain, newIntrospector(cfg, endpoint))
+		}
+		defaultIntrospector = chain
+	}
+
+	m := &Middleware{
+		cfg:          cfg,
+		introspector: defaultIntrospector,
+		endpoints:    make(map[string]Introspector, len(cfg.Endpoints)),
+		primary:      primary,
+		probes:       make(map[string]Introspector, len(cfg.Endpoints)),
+		unauthorized: unauthorizedHandler(cfg),
+		circuit:      newBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerWindow, cfg.CircuitBreakerCooldown, cfg.Now),
+		decisions:    newDecisionCache(cfg.DecisionCacheTTL, cfg.DecisionCacheSize, cfg.Now),
+	}
+
+	for name, endpoint := range cfg.Endpoints {
+		endpoint.Scopes = nil
+		m.endpoints[name] = newIntrospector(cfg, endpoint)
+		m.probes[name] = m.endpoints[name]
+	}
+
+	if cfg.MaxConcurrentIntrospections > 0 {
+		sem := semaphore.NewWeighted(int64(cfg.MaxConcurrentIntrospections))
+		limit := func(i Introspector) Introspector {
+			return &limitedIntrospector{introspector: i, sem: sem, reject: cfg.RejectWhenSaturated}
+		}
+
+		m.introspector = limit(m.introspector)
+		for name, i := range m.endpoints {
+			m.endpoints[name] = limit(i)
+		}
+	}
+
+	if p, ok := cfg.Cache.(purger); ok {
+		go purge(ctx, p, cfg.CacheCleanupInterval)
+	}
+	if m.decisions != nil {
+		go purge(ctx, m.decisions, cfg.CacheCleanupInterval)
+	}
+
+	return m
+}
+
+// Prewarm introspects tokens against the embedded Config endpoint and
+// stores the active results in Config.Cache, respecting their exp claim.
+// It carries on after failures and returns them as a *PrewarmError.
+func (m *Middleware) Prewarm(ctx context.Context, tokens []string) error {
+	if m.cfg.Cache == nil {
+		return ErrNoCache
+	}
+
+	failed := make(map[int]error)
+	for n, token := range tokens {
+		if err := ctx.Err(); err != nil {
+			failed[n] = err
+			continue
+		}
+
+		result, err := introspectWithRetry(ctx, m.introspector, token, m.cfg)
+		if err == nil && (result == nil || !result.Active || expired(result, m.cfg.Now())) {
+			err = introspection.ErrUnauthorized
+		}
+		if err != nil {
+			failed[n] = err
+			continue
+		}
+
+		if ttl := cacheTTL(result, m.cfg.CacheTTL, m.cfg.Now()); ttl > 0 {
+			if err := m.cacheSet(ctx, m.cacheKey(token), result, ttl); err != nil {
+				failed[n] = err
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return &PrewarmError{Errors: failed}
+	}
+	return nil
+}
+
+// InvalidateToken removes the cached result of token, active or not and
+// whatever ExtraParams it was obtained with, and its decisions for every
+// route, so that the next request introspects it again.
+func (m *Middleware) InvalidateToken(token string) error {
+	m.decisions.delete(m.cacheKey(token))
+	if m.cfg.Cache == nil {
+		return nil
+	}
+
+	ctx, cancel := m.cacheContext(context.Background())
+	defer cancel()
+	return m.cfg.Cache.Delete(ctx, m.cacheKey(token))
+}
+
+// InvalidateAll removes every cached result and decision, e.g. after the
+// authorization server rotated its keys. With a CacheNamespace only the
+// results of the namespace are removed, provided the Cache implements
+// ClearPrefix(ctx, prefix). ErrCacheNotClearable is returned, with the
+// results kept, when the Cache does not implement Clear, or ClearPrefix with
+// a namespace.
+func (m *Middleware) InvalidateAll() error {
+	m.decisions.clear()
+
+	if m.cfg.Cache == nil {
+		return nil
+	}
+
+	ctx, cancel := m.cacheContext(context.Background())
+	defer cancel()
+
+	if m.cfg.CacheNamespace != "" {
+		if c, ok := m.cfg.Cache.(prefixClearer); ok {
+			return c.ClearPrefix(ctx, m.cfg.CacheNamespace+":")
+		}
+		return ErrCacheNotClearable
+	}
+
+	if c, ok := m.cfg.Cache.(clearer); ok {
+		return c.Clear(ctx)
+	}
+	return ErrCacheNotClearable
+}
+
+// healthCheckToken is the token HealthCheck introspects. It is not expected
+// to be active.
+const healthCheckToken = "introspect-health-check"
+
+// HealthCheck introspects a sentinel token against the embedded Config
+// endpoint and every entry of Endpoints, e.g. for a readiness probe. An
+// endpoint answering with a verdict, normally inactive, is healthy; transport
+// errors, rejected client credentials and malformed responses are returned.
+// Each endpoint is probed on its own within Config.Timeout: Fallbacks do not
+// stand in for a failing embedded endpoint, and MaxConcurrentIntrospections
+// does not apply. The cache, circuit breaker and metrics are bypassed.
+func (m *Middleware) HealthCheck(ctx context.Context) error {
+	if m.cfg.IntrospectionURL != "" || m.cfg.Introspector != nil {
+		if err := m.healthCheck(ctx, m.primary); err != nil {
+			return fmt.Errorf("introspect: health check failed: %w", err)
+		}
+	}
+
+	names := make([]string, 0, len(m.probes))
+	for name := range m.probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := m.healthCheck(ctx, m.probes[name]); err != nil {
+			return fmt.Errorf("introspect: health check of Endpoints[%q] failed: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (m *Middleware) healthCheck(ctx context.Context, i Introspector) error {
+	if m.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.Timeout)
+		defer cancel()
+	}
+
+	_, err := introspectContext(ctx, i, healthCheckToken)
+	switch err {
+	case nil, introspection.ErrUnauthorized, introspection.ErrForbidden:
+		return nil
+	}
+	return err
+}
+
+// PrewarmError reports the tokens Prewarm failed to introspect by their
+// index, so that tokens never end up in logs.
+type PrewarmError struct {
+	Errors map[int]error
+}
+
+func (e *PrewarmError) Error() string {
+	indexes := make([]int, 0, len(e.Errors))
+	for n := range e.Errors {
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+
+	msgs := make([]string, len(indexes))
+	for i, n := range indexes {
+		msgs[i] = fmt.Sprintf("token %d: %v", n, e.Errors[n])
+	}
+	return "introspect: prewarm failed for " + strings.Join(msgs, "; ")
+}
+
+// Stats returns the counters of m since it was created or last reset.
+// Counters are read one by one while requests may still be updating them.
+func (m *Middleware) Stats() Stats {
+	return m.stats.load()
+}
+
+// ResetStats sets every counter of m back to zero.
+func (m *Middleware) ResetStats() {
+	m.stats.reset()
+}
+
+func (m *Middleware) cacheKey(token string) string {
+	if m.cfg.CacheNamespace != "" {
+		return m.cfg.CacheNamespace + ":" + cacheKey(token, m.cfg.CacheKeySalt)
+	}
+	return cacheKey(token, m.cfg.CacheKeySalt)
+}
+
+// cacheContext bounds ctx by Config.CacheTimeout.
+func (m *Middleware) cacheContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.cfg.CacheTimeout > 0 {
+		return context.WithTimeout(ctx, m.cfg.CacheTimeout)
+	}
+	return ctx, func() {}
+}
+
+// cacheEntry is the JSON stored in Cache. Expires lets RefreshAhead tell
+// how long the entry has left, whatever the store. Params are the encoded
+// ExtraParams the result was obtained with, so that a token has a single
+// key InvalidateToken can delete.
+type cacheEntry struct {
+	Result  *introspection.Result `json:"result"`
+	Expires int64                 `json:"expires"`
+	Params  string                `json:"params,omitempty"`
+}
+
+// cacheGet returns the result cached for key and when the entry expires. A
+// miss is reported as ErrCacheMiss, as are values that cannot be decoded
+// and results obtained with other ExtraParams than those carried by ctx.
+func (m *Middleware) cacheGet(ctx context.Context, key string) (*introspection.Result, time.Time, error) {
+	ctx, cancel := m.cacheContext(ctx)
+	defer cancel()
+
+	data, err := m.cfg.Cache.Get(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Result == nil || entry.Params != extraParams(ctx).Encode() {
+		return nil, time.Time{}, ErrCacheMiss
+	}
+	return entry.Result, time.UnixMilli(entry.Expires), nil
+}
+
+// cacheSet stores result for key for at most ttl, along with the
+// ExtraParams carried by ctx.
+func (m *Middleware) cacheSet(ctx context.Context, key string, result *introspection.Result, ttl time.Duration) error {
+	data, err := json.Marshal(cacheEntry{
+		Result:  result,
+		Expires: m.cfg.Now().Add(ttl).UnixMilli(),
+		Params:  extraParams(ctx).Encode(),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := m.cacheContext(ctx)
+	defer cancel()
+	return m.cfg.Cache.Set(ctx, key, data, ttl)
+}
+
+// refresh introspects token in the background to replace the cached entry
+// under key before it expires. Concurrent refreshes of key share one call,
+// and their outcome never affects the request that triggered them.
+func (m *Middleware) refresh(ctx context.Context, c *fiber.Ctx, token, key string) {
+	i := m.introspector
+	if m.cfg.EndpointResolver != nil {
+		if i = m.endpoints[m.cfg.EndpointResolver(c, token)]; i == nil {
+			return
+		}
+	}
+
+	// The token must outlive the request, see introspectRemote.
+	token = utils.CopyString(token)
+
+	// The refresh must not end with the request, but keeps its ExtraParams
+	// and PropagateHeaders.
+	params, header := extraParams(ctx), propagatedHeaders(ctx)
+
+	// DoChan does not block and its buffered channel may go unread.
+	m.refreshes.DoChan(key, func() (interface{}, error) {
+		if !m.circuit.allow() {
+			return nil, nil
+		}
+
+		ctx := context.Background()
+		if params != nil {
+			ctx = context.WithValue(ctx, extraParamsKey{}, params)
+		}
+		if header != nil {
+			ctx = context.WithValue(ctx, propagatedHeadersKey{}, header)
+		}
+		result, err := introspectWithRetry(ctx, i, token, m.cfg)
+		m.circuit.record(err)
+
+		if isInactive(result, err) {
+			m.decisions.delete(m.cacheKey(token))
+		}
+
+		switch {
+		case err == nil && result != nil && result.Active:
+			if ttl := cacheTTL(result, m.cfg.CacheTTL, m.cfg.Now()); ttl > 0 {
+				_ = m.cacheSet(ctx, key, result, ttl)
+			}
+		case isInactive(result, err) && m.cfg.NegativeCacheTTL > 0:
+			_ = m.cacheSet(ctx, key, &introspection.Result{Active: false}, m.cfg.NegativeCacheTTL)
+		case isInactive(result, err):
+			_ = m.cfg.Cache.Delete(ctx, key)
+		}
+		return nil, nil
+	})
+}
+
+func (m *Middleware) report(c *fiber.Ctx, o *outcome, event string, err error) {
+	m.reportLabeled(c, o, event, Labels{}, err)
+}
+
+// reportLabeled is report passing labels to LabeledMetrics.
+func (m *Middleware) reportLabeled(c *fiber.Ctx, o *outcome, event string, labels Labels, err error) {
+	if o != nil && event != EventIntrospect {
+		o.err = err
+	}
+	m.cfg.Logger(c, event, err)
+	m.stats.event(event)
+	if event == EventIntrospect {
+		return
+	}
+	if lm, ok := m.cfg.Metrics.(LabeledMetrics); ok {
+		lm.CountLabeled(event, labels)
+	} else {
+		m.cfg.Metrics.Count(event)
+	}
+}
+
+// Handler returns the fiber.Handler of the middleware. Every handler
+// returned shares the cache, circuit breaker and in-flight calls of m.
+func (m *Middleware) Handler() fiber.Handler {
+	return m.handle
+}
+
+func (m *Middleware) handle(c *fiber.Ctx) error {
+	cfg := &m.cfg
+
+	if (cfg.Next != nil && cfg.Next(c)) || (cfg.Filter != nil && cfg.Filter(c)) || skipRequest(*cfg, c) {
+		return c.Next()
+	}
+
+	m.stats.requests.Add(1)
+	c.Locals(middlewareKey{}, m)
+
+	if cfg.After == nil {
+		return m.serve(c, nil)
+	}
+
+	var o outcome
+	err := m.serve(c, &o)
+	cfg.After(c, o.result, o.err)
+	return err
+}
+
+// outcome records the decision taken for a request for Config.After.
+type outcome struct {
+	result *introspection.Result
+	err    error
+}
+
+// serve authenticates and authorizes c, recording the decision in o
+// unless it is nil.
+func (m *Middleware) serve(c *fiber.Ctx, o *outcome) error {
+	cfg := &m.cfg
+
+	if cfg.TokensLookup != nil {
+		return m.serveBatch(c, o)
+	}
+
+	token := cfg.TokenLookup(c)
+	if token == "" && cfg.Optional {
+		return c.Next()
+	}
+	if token == "" && !cfg.AllowEmptyToken {
+		m.report(c, o, EventUnauthorized, ErrMissingToken)
+		return m.unauthorized(c, ErrMissingToken)
+	}
+
+	g, err := m.authorize(c, o, token)
+	if g == nil {
+		return err
+	}
+
+	m.reportLabeled(c, o, EventSuccess, Labels{Source: g.source}, nil)
+	m.store(c, g.result, g.scopes, g.principal)
+	return m.succeed(c, g.result)
+}
+
+// serveBatch is serve for Config.TokensLookup. Every token must be granted
+// for c to proceed.
+func (m *Middleware) serveBatch(c *fiber.Ctx, o *outcome) error {
+	cfg := &m.cfg
+
+	tokens := cfg.TokensLookup(c)
+	if len(tokens) == 0 && cfg.Optional {
+		return c.Next()
+	}
+	if len(tokens) == 0 || (containsString(tokens, "") && !cfg.AllowEmptyToken) {
+		m.report(c, o, EventUnauthorized, ErrMissingToken)
+		return m.unauthorized(c, ErrMissingToken)
+	}
+
+	var first *grant
+	results := make([]*introspection.Result, len(tokens))
+	for n, token := range tokens {
+		g, err := m.authorize(c, o, token)
+		if g == nil {
+			return err
+		}
+		if n == 0 {
+			first = g
+		}
+		results[n] = m.visible(g.result)
+	}
+
+	if o != nil {
+		o.result = first.result
+	}
+	m.reportLabeled(c, o, EventSuccess, Labels{Source: first.source}, nil)
+	m.store(c, first.result, first.scopes, first.principal)
+	c.Locals(resultsKey{}, results)
+	return m.succeed(c, first.result)
+}
+
+// grant is what authorize found out about a token allowed to proceed.
+type grant struct {
+	result    *introspection.Result
+	scopes    []string
+	principal interface{}
+	source    string
+}
+
+// authorize introspects token and applies the checks of the config to the
+// result. A nil grant means c has been responded to, returning the error.
+func (m *Middleware) authorize(c *fiber.Ctx, o *outcome, token string) (*grant, error) {
+	cfg := &m.cfg
+
+	if cfg.MaxTokenLength > 0 && len(token) > cfg.MaxTokenLength {
+		m.report(c, o, EventUnauthorized, ErrTokenTooLong)
+		return nil, m.unauthorized(c, ErrTokenTooLong)
+	}
+
+	if cfg.BeforeIntrospect != nil {
+		if err := cfg.BeforeIntrospect(c, token); err != nil {
+			m.report(c, o, EventError, err)
+			return nil, cfg.ErrorHandler(c, err)
+		}
+	}
+
+	var (
+		result   *introspection.Result
+		err      error
+		cached   bool
+		local    bool
+		remote   bool
+		cacheKey string
+	)
+
+	ctx, endSpan := cfg.StartSpan(c.UserContext())
+
+	if cfg.ExtraParams != nil {
+		ctx = withExtraParams(ctx, cfg.ExtraParams(c))
+	}
+
+	if len(cfg.PropagateHeaders) > 0 {
+		ctx = withPropagatedHeaders(ctx, c, cfg.PropagateHeaders)
+	}
+
+	var tokenKey, route string
+	if m.decisions != nil {
+		tokenKey, route = m.cacheKey(token), decisionRoute(ctx, c)
+		d := m.decisions.get(tokenKey, route)
+		m.stats.decision(d != nil)
+		if d != nil {
+			endSpan(true, nil)
+			return m.replay(c, o, d)
+		}
+	}
+
+	if cfg.Cache != nil {
+		cacheKey = m.cacheKey(token)
+		var (
+			expires  time.Time
+			cacheErr error
+		)
+		result, expires, cacheErr = m.cacheGet(ctx, cacheKey)
+		if cacheErr != nil && !errors.Is(cacheErr, ErrCacheMiss) {
+			cfg.Logger(c, EventCacheError, cacheErr)
+		}
+		cached = cacheErr == nil
+		m.stats.cache(cached)
+
+		if cached && result.Active && cfg.RefreshAhead > 0 && expires.Sub(cfg.Now()) < cfg.RefreshAhead {
+			m.refresh(ctx, c, token, cacheKey)
+		}
+	}
+
+	if !cached && cfg.JWTVerify != nil && (!cfg.AutoDetectJWT || cfg.IsJWT(token)) {
+		result, local, err = cfg.JWTVerify(token)
+	}
+
+	// Only misses reach the circuit breaker, so cached results are still
+	// served while it is open.
+	if !cached && !local && err == nil {
+		result, err = m.introspectRemote(ctx, c, token)
+		remote = err != ErrUnknownIssuer && err != ErrCircuitOpen
+	}
+
+	endSpan(cached, err)
+
+	if remote && cfg.Cache != nil && cfg.NegativeCacheTTL > 0 && isInactive(result, err) {
+		if err := m.cacheSet(ctx, cacheKey, &introspection.Result{Active: false}, cfg.NegativeCacheTTL); err != nil {
+			cfg.Logger(c, EventCacheError, err)
+		}
+	}
+
+	// An inactive token is a valid RFC 7662 response, not a failure. It is
+	// handled as the unauthorized verdict, whether it was introspected or
+	// negatively cached, as is an expired one, whatever produced it.
+	if err == nil && (result == nil || !result.Active || expired(result, cfg.Now())) {
+		err = introspection.ErrUnauthorized
+	}
+
+	// Every result is checked, whatever produced it, as cached and local
+	// ones may have been obtained for other requirements and custom
+	// introspectors need not check them.
+	if err == nil && !allowedBy(m.endpointConfig(c, token), result) {
+		err = introspection.ErrForbidden
+	}
+
+	switch {
+	case err == introspection.ErrForbidden && cfg.TreatForbiddenAsUnauthorized:
+		err = introspection.ErrUnauthorized
+	case err == introspection.ErrUnauthorized && cfg.TreatUnauthorizedAsForbidden:
+		err = introspection.ErrForbidden
+	}
+
+	if err != nil && cfg.FailOpen && (remote || err == ErrCircuitOpen) && unreachable(err) {
+		m.reportLabeled(c, o, EventError, Labels{Reason: failureReason(err)}, err)
+		return nil, c.Next()
+	}
+
+	if err != nil && cfg.ErrorMapper != nil {
+		if handler, ok := cfg.ErrorMapper(err); ok {
+			m.report(c, o, EventError, err)
+			return nil, handler(c)
+		}
+	}
+
+	if err != nil {
+		switch err {
+		case introspection.ErrUnauthorized:
+			m.reportLabeled(c, o, EventUnauthorized, Labels{Reason: ReasonInactive}, err)
+			return nil, m.unauthorized(c, err)
+		case ErrUnknownIssuer:
+			m.report(c, o, EventUnauthorized, err)
+			return nil, m.unauthorized(c, err)
+		case introspection.ErrForbidden:
+			m.report(c, o, EventForbidden, err)
+			return nil, cfg.Forbidden(c)
+		case ErrCircuitOpen:
+			m.reportLabeled(c, o, EventError, Labels{Reason: ReasonTransport}, err)
+			if cfg.OnCircuitOpen != nil {
+				return nil, cfg.OnCircuitOpen(c)
+			}
+			return nil, cfg.ErrorHandler(c, err)
+		default:
+			var labels Labels
+			if remote {
+				labels.Reason = failureReason(err)
+			}
+			m.reportLabeled(c, o, EventError, labels, err)
+			var limited *RateLimitError
+			if errors.As(err, &limited) {
+				if limited.RetryAfter != "" {
+					c.Set(fiber.HeaderRetryAfter, limited.RetryAfter)
+				}
+				if cfg.RateLimited != nil {
+					return nil, cfg.RateLimited(c)
+				}
+				return nil, c.SendStatus(fiber.StatusServiceUnavailable)
+			}
+			return nil, cfg.ErrorHandler(c, err)
+		}
+	}
+
+	if nbf, ok := notBefore(result); ok && time.Unix(nbf, 0).After(cfg.Now().Add(cfg.ClockSkew)) {
+		m.report(c, o, EventUnauthorized, introspection.ErrUnauthorized)
+		return nil, m.unauthorized(c, introspection.ErrUnauthorized)
+	}
+
+	if o != nil {
+		o.result = result
+	}
+
+	if remote && cfg.Cache != nil {
+		if ttl := cacheTTL(result, cfg.CacheTTL, cfg.Now()); ttl > 0 {
+			if err := m.cacheSet(ctx, cacheKey, result, ttl); err != nil {
+				cfg.Logger(c, EventCacheError, err)
+			}
+		}
+	}
+
+	if revoked, err := m.revoked(c, o, result); revoked {
+		return nil, err
+	}
+
+	required := cfg.Scopes
+	if cfg.ScopesFunc != nil {
+		required = cfg.ScopesFunc(c)
+	}
+
+	scopes := parseScopes(result.Scope)
+	if !hasScopes(scopes, required, !cfg.AnyScope, cfg.ScopeStrategy) {
+		missing := missingScopes(scopes, required, cfg.ScopeStrategy)
+		return nil, m.deny(c, o, tokenKey, route, introspection.ErrForbidden, missing)
+	}
+
+	if cfg.RequiredAudience != "" && !containsString(result.Audience, cfg.RequiredAudience) {
+		return nil, m.deny(c, o, tokenKey, route, introspection.ErrForbidden, nil)
+	}
+
+	if len(cfg.AllowedIssuers) > 0 && !containsString(cfg.AllowedIssuers, result.Issuer) {
+		return nil, m.deny(c, o, tokenKey, route, introspection.ErrForbidden, nil)
+	}
+
+	if len(cfg.RequiredClaims) > 0 && !hasClaims(claimsOf(result), cfg.RequiredClaims) {
+		return nil, m.deny(c, o, tokenKey, route, introspection.ErrForbidden, nil)
+	}
+
+	if cfg.VerifyDPoP {
+		if err := verifyDPoP(c, token, result, cfg.ClockSkew, cfg.Now()); err != nil {
+			m.report(c, o, EventForbidden, err)
+			return nil, cfg.Forbidden(c)
+		}
+	}
+
+	if cfg.VerifyCertBound {
+		if err := verifyCertBound(c, result); err != nil {
+			m.report(c, o, EventForbidden, err)
+			return nil, cfg.Forbidden(c)
+		}
+	}
+
+	if cfg.ClaimsValidator != nil {
+		if err := cfg.ClaimsValidator(c, result); err != nil {
+			if errors.Is(err, ErrClaimsValidator) {
+				m.report(c, o, EventError, err)
+				return nil, cfg.ErrorHandler(c, err)
+			}
+			return nil, m.deny(c, o, tokenKey, route, err, nil)
+		}
+	}
+
+	m.decisions.set(tokenKey, route, &decision{
+		result:  result,
+		scopes:  scopes,
+		expires: cfg.Now().Add(cacheTTL(result, cfg.DecisionCacheTTL, cfg.Now())),
+	})
+
+	source := SourceRemote
+	if cached {
+		source = SourceCache
+	} else if local {
+		source = SourceLocal
+	}
+
+	return m.allow(c, o, result, scopes, source)
+}
+
+// replay answers c with a decision remembered by the decision cache. Only
+// RevocationChecker and Transform run again for an allowed token.
+func (m *Middleware) replay(c *fiber.Ctx, o *outcome, d *decision) (*grant, error) {
+	if d.result == nil {
+		return nil, m.forbid(c, o, d.err, d.missing)
+	}
+
+	if o != nil {
+		o.result = d.result
+	}
+	if revoked, err := m.revoked(c, o, d.result); revoked {
+		return nil, err
+	}
+	return m.allow(c, o, d.result, d.scopes, SourceCache)
+}
+
+// revoked reports whether RevocationChecker rejected result, in which case
+// c has been responded to with the returned error.
+func (m *Middleware) revoked(c *fiber.Ctx, o *outcome, result *introspection.Result) (bool, error) {
+	jti := tokenID(result)
+	if jti == "" || m.cfg.RevocationChecker == nil {
+		return false, nil
+	}
+
+	revoked, err := m.cfg.RevocationChecker(jti)
+	if err != nil {
+		m.report(c, o, EventError, err)
+		return true, m.cfg.ErrorHandler(c, err)
+	}
+	if revoked {
+		m.report(c, o, EventUnauthorized, ErrTokenRevoked)
+		return true, m.unauthorized(c, ErrTokenRevoked)
+	}
+	return false, nil
+}
+
+// deny is forbid remembering the denial of the token on route in the
+// decision cache.
+func (m *Middleware) deny(c *fiber.Ctx, o *outcome, tokenKey, route string, err error, missing []string) error {
+	m.decisions.set(tokenKey, route, &decision{
+		err:     err,
+		missing: missing,
+		expires: m.cfg.Now().Add(m.cfg.DecisionCacheTTL),
+	})
+	return m.forbid(c, o, err, missing)
+}
+
+// forbid reports err and responds with Forbidden, or OnMissingScopes when
+// missing lists the scopes the token lacks.
+func (m *Middleware) forbid(c *fiber.Ctx, o *outcome, err error, missing []string) error {
+	m.report(c, o, EventForbidden, err)
+	if missing != nil && m.cfg.OnMissingScopes != nil {
+		return m.cfg.OnMissingScopes(c, missing)
+	}
+	return m.cfg.Forbidden(c)
+}
+
+// allow runs Transform and builds the grant of an allowed token.
+func (m *Middleware) allow(c *fiber.Ctx, o *outcome, result *introspection.Result, scopes []string, source string) (*grant, error) {
+	var principal interface{}
+	if m.cfg.Transform != nil {
+		var err error
+		if principal, err = m.cfg.Transform(c, result); err != nil {
+			m.report(c, o, EventError, err)
+			return nil, m.cfg.ErrorHandler(c, err)
+		}
+	}
+	return &grant{result: result, scopes: scopes, principal: principal, source: source}, nil
+}
+
+// succeed runs the success hooks of the config for result, then the next
+// handler.
+func (m *Middleware) succeed(c *fiber.Ctx, result *introspection.Result) error {
+	cfg := &m.cfg
+
+	if cfg.OnSuccess != nil {
+		if err := cfg.OnSuccess(c, result); err != nil {
+			return err
+		}
+	}
+
+	if cfg.SuccessHandler != nil {
+		if err := cfg.SuccessHandler(c); err != nil {
+			return err
+		}
+	}
+
+	return c.Next()
+}
+
+// endpointConfig returns the configuration of the endpoint c is introspected
+// against: the one selected by EndpointResolver, or the embedded one.
+func (m *Middleware) endpointConfig(c *fiber.Ctx, token string) introspection.Config {
+	if m.cfg.EndpointResolver != nil {
+		return m.cfg.Endpoints[m.cfg.EndpointResolver(c, token)].Config
+	}
+	return m.cfg.Config
+}
+
+// introspectRemote introspects token against the endpoint selected for c,
+// subject to the circuit breaker.
+func (m *Middleware) introspectRemote(ctx context.Context, c *fiber.Ctx, token string) (*introspection.Result, error) {
+	// Shared calls may outlive the request, whose buffers Fiber reuses.
+	token = utils.CopyString(token)
+
+	var (
+		i   = m.introspector
+		key = token
+	)
+	if m.cfg.EndpointResolver != nil {
+		name := m.cfg.EndpointResolver(c, token)
+		if i = m.endpoints[name]; i == nil {
+			return nil, ErrUnknownIssuer
+		}
+		key = name + "\x00" + token
+	}
+	if params := extraParams(ctx); len(params) > 0 {
+		key += "\x00" + params.Encode()
+	}
+
+	if !m.circuit.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	m.report(c, nil, EventIntrospect, nil)
+	start := time.Now()
+	// The shared call records its outcome once, however many requests
+	// wait for it.
+	result, err := introspectShared(ctx, &m.group, key, i, token, m.cfg, m.circuit.record)
+	m.cfg.Metrics.ObserveLatency(time.Since(start))
+	return result, err
+}
+
+// unreachable reports whether err means the introspection endpoint could not
+// be reached or asked to be left alone for now, the failures FailOpen lets
+// requests through on. Other status codes, such as 401 for rejected client
+// credentials, are misconfigurations rather than outages.
+func unreachable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrRateLimited) || errors.As(err, &netErr)
+}
+
+// store puts result and the values derived from it into the context of c.
+// A non-nil principal returned by Transform is stored under ContextKey.
+func (m *Middleware) store(c *fiber.Ctx, result *introspection.Result, scopes []string, principal interface{}) {
+	cfg := &m.cfg
+
+	c.Locals(expiresKey{}, result.Expires)
+
+	if len(cfg.RedactClaims) > 0 {
+		result = redactClaims(result, cfg.RedactClaims)
+	}
+
+	var stored interface{} = result
+	if len(cfg.ResultFields) > 0 {
+		stored = selectFields(result, cfg.ResultFields, cfg.RedactClaims)
+	}
+	c.Locals(resultKey{}, stored)
+
+	if cfg.StoreInUserContext {
+		c.SetUserContext(context.WithValue(c.UserContext(), resultKey{}, stored))
+	}
+
+	if cfg.Transform != nil {
+		c.Locals(cfg.ContextKey, principal)
+	} else {
+		c.Locals(cfg.ContextKey, stored)
+	}
+
+	if len(scopes) > 0 {
+		c.Locals(grantedScopesKey{}, scopes)
+		if !containsString(cfg.RedactClaims, "scope") {
+			c.Locals(scopesKey{}, scopes)
+			c.Locals(cfg.ScopesContextKey, scopes)
+		}
+	}
+
+	if len(cfg.ClaimsToLocals) > 0 {
+		claims := claimsOf(result)
+		for claim, key := range cfg.ClaimsToLocals {
+			// Redacted standard claims still decode, as zero values.
+			if containsString(cfg.RedactClaims, strings.SplitN(claim, ".", 2)[0]) {
+				continue
+			}
+			if value, ok := lookupClaim(claims, claim); ok {
+				c.Locals(key, value)
+			}
+		}
+	}
+}
+
+// visible returns result as FromContext returns it: without RedactClaims
+// and, when ResultFields is set, with only those claims.
+func (m *Middleware) visible(result *introspection.Result) *introspection.Result {
+	if len(m.cfg.RedactClaims) > 0 {
+		result = redactClaims(result, m.cfg.RedactClaims)
+	}
+	if len(m.cfg.ResultFields) > 0 {
+		result = selectFields(result, m.cfg.ResultFields, m.cfg.RedactClaims).Result()
+	}
+	return result
+}
@@ -0,0 +1,132 @@
+package introspect
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Option sets a field of the Config built by NewWithOptions.
+type Option func(*Config)
+
+// NewWithOptions is like New with the Config built from opts, applied in
+// order onto a zero Config. Fields without an option are set with
+// WithConfig or a custom Option.
+func NewWithOptions(opts ...Option) fiber.Handler {
+	return NewWithContext(context.Background(), BuildConfig(opts...))
+}
+
+// BuildConfig applies opts in order onto a zero Config.
+func BuildConfig(opts ...Option) Config {
+	var cfg Config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithConfig replaces the whole Config with config. Options applied after it
+// override its fields.
+func WithConfig(config Config) Option {
+	return func(cfg *Config) {
+		*cfg = config
+	}
+}
+
+// WithIntrospectionURL sets the URL of the introspection endpoint.
+func WithIntrospectionURL(url string) Option {
+	return func(cfg *Config) {
+		cfg.IntrospectionURL = url
+	}
+}
+
+// WithClientCredentials sets ClientID and ClientSecret.
+func WithClientCredentials(id, secret string) Option {
+	return func(cfg *Config) {
+		cfg.ClientID = id
+		cfg.ClientSecret = secret
+	}
+}
+
+// WithHTTPClient sets HTTPClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(cfg *Config) {
+		cfg.HTTPClient = client
+	}
+}
+
+// WithScopes sets the scopes a token must be granted.
+func WithScopes(scopes ...string) Option {
+	return func(cfg *Config) {
+		cfg.Scopes = scopes
+	}
+}
+
+// WithAudience sets RequiredAudience.
+func WithAudience(audience string) Option {
+	return func(cfg *Config) {
+		cfg.RequiredAudience = audience
+	}
+}
+
+// WithCache sets Cache and CacheTTL. A ttl of 0 keeps the default.
+func WithCache(cache Cache, ttl time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.Cache = cache
+		cfg.CacheTTL = ttl
+	}
+}
+
+// WithTimeout sets Timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.Timeout = timeout
+	}
+}
+
+// WithTokenLookup sets TokenLookup.
+func WithTokenLookup(lookup func(*fiber.Ctx) string) Option {
+	return func(cfg *Config) {
+		cfg.TokenLookup = lookup
+	}
+}
+
+// WithOptional sets Optional.
+func WithOptional() Option {
+	return func(cfg *Config) {
+		cfg.Optional = true
+	}
+}
+
+// WithContextKey sets ContextKey.
+func WithContextKey(key string) Option {
+	return func(cfg *Config) {
+		cfg.ContextKey = key
+	}
+}
+
+// WithHandlers sets Unauthorized, Forbidden and ErrorHandler. Nil handlers
+// keep the defaults.
+func WithHandlers(unauthorized, forbidden fiber.Handler, errorHandler func(*fiber.Ctx, error) error) Option {
+	return func(cfg *Config) {
+		cfg.Unauthorized = unauthorized
+		cfg.Forbidden = forbidden
+		cfg.ErrorHandler = errorHandler
+	}
+}
+
+// WithLogger sets Logger.
+func WithLogger(logger func(c *fiber.Ctx, event string, err error)) Option {
+	return func(cfg *Config) {
+		cfg.Logger = logger
+	}
+}
+
+// WithMetrics sets Metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(cfg *Config) {
+		cfg.Metrics = metrics
+	}
+}
@@ -0,0 +1,115 @@
+package introspect
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestBuildConfig(t *testing.T) {
+	client := &http.Client{}
+	cache := NewMemoryCache(0)
+	lookup := TokenFromHeader("X-Token", "")
+	handler := func(c *fiber.Ctx) error { return nil }
+	metrics := &recordingMetrics{}
+	var logged, errorHandled bool
+
+	cfg := BuildConfig(
+		WithConfig(Config{ContextKey: "replaced", MaxRetries: 3}),
+		WithIntrospectionURL("https://auth.example.com/introspect"),
+		WithClientCredentials("id", "secret"),
+		WithHTTPClient(client),
+		WithScopes("read", "write"),
+		WithAudience("orders"),
+		WithCache(cache, time.Minute),
+		WithTimeout(time.Second),
+		WithTokenLookup(lookup),
+		WithOptional(),
+		WithContextKey("principal"),
+		WithHandlers(handler, nil, func(*fiber.Ctx, error) error { errorHandled = true; return nil }),
+		WithLogger(func(*fiber.Ctx, string, error) { logged = true }),
+		WithMetrics(metrics),
+	)
+
+	if cfg.IntrospectionURL != "https://auth.example.com/introspect" {
+		t.Errorf("IntrospectionURL = %q", cfg.IntrospectionURL)
+	}
+	if cfg.ClientID != "id" || cfg.ClientSecret != "secret" {
+		t.Errorf("credentials = %q, %q", cfg.ClientID, cfg.ClientSecret)
+	}
+	if cfg.HTTPClient != client {
+		t.Error("HTTPClient not set")
+	}
+	if len(cfg.Scopes) != 2 || cfg.Scopes[0] != "read" || cfg.Scopes[1] != "write" {
+		t.Errorf("Scopes = %q", cfg.Scopes)
+	}
+	if cfg.RequiredAudience != "orders" {
+		t.Errorf("RequiredAudience = %q", cfg.RequiredAudience)
+	}
+	if cfg.Cache != cache || cfg.CacheTTL != time.Minute {
+		t.Errorf("Cache, CacheTTL = %v, %v", cfg.Cache, cfg.CacheTTL)
+	}
+	if cfg.Timeout != time.Second {
+		t.Errorf("Timeout = %v", cfg.Timeout)
+	}
+	if cfg.TokenLookup == nil || !cfg.Optional {
+		t.Errorf("TokenLookup, Optional = %v, %t", cfg.TokenLookup != nil, cfg.Optional)
+	}
+	if cfg.ContextKey != "principal" {
+		t.Errorf("ContextKey = %q, want the later option to win", cfg.ContextKey)
+	}
+	if cfg.MaxRetries != 3 {
+		t.Errorf("MaxRetries = %d, want it kept from WithConfig", cfg.MaxRetries)
+	}
+	if cfg.Unauthorized == nil || cfg.Forbidden != nil || cfg.ErrorHandler == nil {
+		t.Error("handlers not set as given")
+	}
+	if cfg.ErrorHandler(nil, nil); !errorHandled {
+		t.Error("ErrorHandler not the one given")
+	}
+	if cfg.Logger(nil, "", nil); !logged {
+		t.Error("Logger not the one given")
+	}
+	if cfg.Metrics != Metrics(metrics) {
+		t.Errorf("Metrics = %T, want the one given", cfg.Metrics)
+	}
+}
+
+func TestWithConfigReplaces(t *testing.T) {
+	cfg := BuildConfig(
+		WithScopes("read"),
+		WithTimeout(time.Second),
+		WithConfig(Config{ContextKey: "principal"}),
+	)
+	if cfg.Scopes != nil || cfg.Timeout != 0 || cfg.ContextKey != "principal" {
+		t.Errorf("WithConfig kept earlier options: %+v", cfg)
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{"scope": "read"})))
+
+	tests := []struct {
+		name   string
+		scopes []string
+		token  string
+		want   int
+	}{
+		{"granted", []string{"read"}, "token", fiber.StatusOK},
+		{"missing scope", []string{"write"}, "token", fiber.StatusForbidden},
+		{"no token", []string{"read"}, "", fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(NewWithOptions(
+				WithIntrospectionURL(e.URL),
+				WithScopes(tt.scopes...),
+			))
+			if got := send(t, app, newRequest("/", tt.token)); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
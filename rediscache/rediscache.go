@@ -0,0 +1,89 @@
+// Package rediscache provides an introspect.Cache backed by Redis, so that
+// introspection results and revocations are shared by every instance.
+package rediscache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	introspect "github.com/arsmn/fiber-introspect"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ introspect.Cache = (*Cache)(nil)
+
+// Cache is an introspect.Cache storing values in Redis.
+type Cache struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// New creates a Cache storing keys under prefix, e.g. "introspect:".
+func New(client redis.UniversalClient, prefix string) *Cache {
+	return &Cache{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Get implements introspect.Cache.
+func (c *Cache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, introspect.ErrCacheMiss
+	}
+	return value, err
+}
+
+// Set implements introspect.Cache.
+func (c *Cache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	return c.client.Set(ctx, c.prefix+key, value, ttl).Err()
+}
+
+// Delete implements introspect.Cache.
+func (c *Cache) Delete(ctx context.Context, key string) error {
+	return c.client.Del(ctx, c.prefix+key).Err()
+}
+
+// ErrNoPrefix is returned by Clear when the Cache has no prefix, rather than
+// flushing unrelated keys.
+var ErrNoPrefix = errors.New("rediscache: clearing requires a prefix")
+
+// Clear removes every key under the prefix.
+func (c *Cache) Clear(ctx context.Context) error {
+	return c.ClearPrefix(ctx, "")
+}
+
+// ClearPrefix removes every key under the prefix followed by prefix, e.g. the
+// CacheNamespace of a middleware. It returns ErrNoPrefix when both are empty.
+func (c *Cache) ClearPrefix(ctx context.Context, prefix string) error {
+	if c.prefix+prefix == "" {
+		return ErrNoPrefix
+	}
+
+	iter := c.client.Scan(ctx, 0, matchPrefix(c.prefix+prefix), 100).Iterator()
+	for iter.Next(ctx) {
+		if err := c.client.Del(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// matchPrefix returns the SCAN pattern matching the keys starting with prefix,
+// escaping the glob characters it contains.
+func matchPrefix(prefix string) string {
+	var b strings.Builder
+	for _, r := range prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String() + "*"
+}
@@ -0,0 +1,19 @@
+package rediscache
+
+import "testing"
+
+func TestMatchPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"introspect:", "introspect:*"},
+		{"introspect:orders:", "introspect:orders:*"},
+		{`svc*[a]?\:`, `svc\*\[a\]\?\\:*`},
+	}
+	for _, tt := range tests {
+		if got := matchPrefix(tt.prefix); got != tt.want {
+			t.Errorf("matchPrefix(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package introspect
+
+import (
+	"encoding/json"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// unauthorizedHandler returns the function used to respond to unauthorized
+// requests. Custom Unauthorized handlers are called as is, while the default
+// one sends an RFC 6750 WWW-Authenticate challenge describing err, or a
+// Proxy-Authenticate one with ProxyAuthRequired, and a negotiated body.
+func unauthorizedHandler(cfg Config) func(*fiber.Ctx, error) error {
+	if cfg.Unauthorized != nil {
+		return func(c *fiber.Ctx, _ error) error {
+			return cfg.Unauthorized(c)
+		}
+	}
+
+	return func(c *fiber.Ctx, err error) error {
+		realm := cfg.Realm
+		if cfg.RealmFunc != nil {
+			realm = cfg.RealmFunc(c)
+		}
+		if cfg.ProxyAuthRequired {
+			c.Set(fiber.HeaderProxyAuthenticate, bearerChallenge(cfg.AuthScheme, realm, err))
+			return negotiate(c, fiber.StatusProxyAuthRequired, unauthorizedDetail, cfg.UnauthorizedMessage, cfg.ContentType)
+		}
+		c.Set(fiber.HeaderWWWAuthenticate, bearerChallenge(cfg.AuthScheme, realm, err))
+		return negotiate(c, fiber.StatusUnauthorized, unauthorizedDetail, cfg.UnauthorizedMessage, cfg.ContentType)
+	}
+}
+
+// Details of the default unauthorized and forbidden responses.
+const (
+	unauthorizedDetail = "The access token is missing, invalid or expired."
+	forbiddenDetail    = "The access token does not grant access to this resource."
+)
+
+// negotiate responds with status in the format preferred by the Accept
+// header of c: RFC 7807 problem details as JSON, a minimal HTML page or the
+// status text. A non-empty message is sent as is instead.
+func negotiate(c *fiber.Ctx, status int, detail, message, contentType string) error {
+	if message != "" {
+		return sendStatus(c, status, message, contentType)
+	}
+
+	switch c.Accepts(fiber.MIMETextPlain, fiber.MIMEApplicationJSON, fiber.MIMETextHTML) {
+	case fiber.MIMEApplicationJSON:
+		return c.Status(status).JSON(Problem{
+			Type:   "about:blank",
+			Title:  utils.StatusMessage(status),
+			Status: status,
+			Detail: detail,
+		})
+	case fiber.MIMETextHTML:
+		title := html.EscapeString(strconv.Itoa(status) + " " + utils.StatusMessage(status))
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		return c.Status(status).SendString("<!DOCTYPE html><html><head><title>" + title + "</title></head><body><h1>" +
+			title + "</h1><p>" + html.EscapeString(detail) + "</p></body></html>")
+	}
+	return sendStatus(c, status, "", contentType)
+}
+
+// sendStatus responds with status and message as the body, or the status
+// text when message is empty.
+func sendStatus(c *fiber.Ctx, status int, message, contentType string) error {
+	if message == "" {
+		return c.SendStatus(status)
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Status(status).SendString(message)
+}
+
+// bearerChallenge builds a WWW-Authenticate value. A missing token carries no
+// error code, any other failure is reported as invalid_token.
+func bearerChallenge(scheme, realm string, err error) string {
+	var params []string
+	if realm != "" {
+		params = append(params, `realm="`+strings.ReplaceAll(realm, `"`, `\"`)+`"`)
+	}
+	if err != nil && err != ErrMissingToken {
+		params = append(params, `error="invalid_token"`)
+	}
+
+	if len(params) == 0 {
+		return scheme
+	}
+	return scheme + " " + strings.Join(params, ", ")
+}
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// JSONUnauthorized returns an Unauthorized handler responding with RFC 7807
+// problem details.
+func JSONUnauthorized() fiber.Handler {
+	return problemHandler(Problem{
+		Type:   "about:blank",
+		Title:  "Unauthorized",
+		Status: fiber.StatusUnauthorized,
+		Detail: unauthorizedDetail,
+	})
+}
+
+// JSONForbidden returns a Forbidden handler responding with RFC 7807
+// problem details.
+func JSONForbidden() fiber.Handler {
+	return problemHandler(Problem{
+		Type:   "about:blank",
+		Title:  "Forbidden",
+		Status: fiber.StatusForbidden,
+		Detail: forbiddenDetail,
+	})
+}
+
+func problemHandler(problem Problem) fiber.Handler {
+	body, _ := json.Marshal(problem)
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, "application/problem+json")
+		return c.Status(problem.Status).Send(body)
+	}
+}
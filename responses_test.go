@@ -0,0 +1,204 @@
+package introspect
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// respond sends req to app and returns the response with its body read.
+func respond(t *testing.T, app *fiber.App, req *http.Request) (*http.Response, string) {
+	t.Helper()
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestNegotiatedResponses(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.PostForm.Get("token") == "inactive" {
+			respondJSON(map[string]interface{}{"active": false})(w, r)
+			return
+		}
+		respondJSON(active(nil))(w, r)
+	})
+	config := e.config()
+	config.Scopes = []string{"admin"}
+	app := newTestApp(New(Config{Config: config}))
+
+	tests := []struct {
+		name        string
+		token       string
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"unauthorized json", "inactive", fiber.MIMEApplicationJSON, fiber.StatusUnauthorized, fiber.MIMEApplicationJSON, unauthorizedDetail},
+		{"forbidden json", "token", fiber.MIMEApplicationJSON, fiber.StatusForbidden, fiber.MIMEApplicationJSON, forbiddenDetail},
+		{"unauthorized html", "inactive", fiber.MIMETextHTML, fiber.StatusUnauthorized, fiber.MIMETextHTML, "<h1>401 Unauthorized</h1>"},
+		{"forbidden html", "token", fiber.MIMETextHTML, fiber.StatusForbidden, fiber.MIMETextHTML, "<h1>403 Forbidden</h1>"},
+		{"unauthorized text", "inactive", fiber.MIMETextPlain, fiber.StatusUnauthorized, fiber.MIMETextPlain, "Unauthorized"},
+		{"no preference", "token", "", fiber.StatusForbidden, fiber.MIMETextPlain, "Forbidden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newRequest("/", tt.token)
+			if tt.accept != "" {
+				req.Header.Set(fiber.HeaderAccept, tt.accept)
+			}
+			resp, body := respond(t, app, req)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get(fiber.HeaderContentType); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if !strings.Contains(body, tt.body) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.body)
+			}
+			if tt.contentType != fiber.MIMEApplicationJSON {
+				return
+			}
+			var problem Problem
+			if err := json.Unmarshal([]byte(body), &problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Status != tt.status || problem.Title != http.StatusText(tt.status) || problem.Type != "about:blank" {
+				t.Errorf("problem = %+v", problem)
+			}
+		})
+	}
+}
+
+func TestProblemHandlers(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(map[string]interface{}{"active": r.PostForm.Get("token") == "token"})(w, r)
+	})
+	config := e.config()
+	config.Scopes = []string{"admin"}
+	app := newTestApp(New(Config{Config: config, Unauthorized: JSONUnauthorized(), Forbidden: JSONForbidden()}))
+
+	for token, want := range map[string]Problem{
+		"inactive": {Type: "about:blank", Title: "Unauthorized", Status: fiber.StatusUnauthorized, Detail: unauthorizedDetail},
+		"token":    {Type: "about:blank", Title: "Forbidden", Status: fiber.StatusForbidden, Detail: forbiddenDetail},
+	} {
+		resp, body := respond(t, app, newRequest("/", token))
+		if resp.StatusCode != want.Status {
+			t.Errorf("%s: status = %d, want %d", token, resp.StatusCode, want.Status)
+		}
+		if got := resp.Header.Get(fiber.HeaderContentType); got != "application/problem+json" {
+			t.Errorf("%s: Content-Type = %q, want application/problem+json", token, got)
+		}
+		var problem Problem
+		if err := json.Unmarshal([]byte(body), &problem); err != nil || problem != want {
+			t.Errorf("%s: problem = %+v (%v), want %+v", token, problem, err, want)
+		}
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(map[string]interface{}{"active": false}))
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		token  string
+		header string
+		status int
+		want   string
+	}{
+		{"missing token", Config{}, "", fiber.HeaderWWWAuthenticate, fiber.StatusUnauthorized, "Bearer"},
+		{"invalid token", Config{}, "token", fiber.HeaderWWWAuthenticate, fiber.StatusUnauthorized, `Bearer error="invalid_token"`},
+		{"realm", Config{Realm: "api"}, "", fiber.HeaderWWWAuthenticate, fiber.StatusUnauthorized, `Bearer realm="api"`},
+		{"realm and error", Config{Realm: `my "api"`}, "token", fiber.HeaderWWWAuthenticate, fiber.StatusUnauthorized, `Bearer realm="my \"api\"", error="invalid_token"`},
+		{"custom handler", Config{Unauthorized: func(c *fiber.Ctx) error {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}}, "token", fiber.HeaderWWWAuthenticate, fiber.StatusUnauthorized, ""},
+		{"forwarded realm", Config{Realm: "api", RealmFunc: func(c *fiber.Ctx) string {
+			return c.Get("X-Forwarded-Host")
+		}}, "", fiber.HeaderWWWAuthenticate, fiber.StatusUnauthorized, `Bearer realm="gateway.example.com"`},
+		{"scheme", Config{AuthScheme: "DPoP", TokenLookup: TokenFromBearer()}, "", fiber.HeaderWWWAuthenticate, fiber.StatusUnauthorized, "DPoP"},
+		{"proxy", Config{ProxyAuthRequired: true, TokenLookup: TokenFromBearer()}, "token", fiber.HeaderProxyAuthenticate, fiber.StatusProxyAuthRequired, `Bearer error="invalid_token"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Config = e.config()
+			app := newTestApp(New(cfg))
+
+			req := newRequest("/", tt.token)
+			req.Header.Set("X-Forwarded-Host", "gateway.example.com")
+			resp, _ := respond(t, app, req)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get(tt.header); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessages(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.PostForm.Get("token") {
+		case "inactive":
+			respondJSON(map[string]interface{}{"active": false})(w, r)
+		case "down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			respondJSON(active(nil))(w, r)
+		}
+	})
+	config := e.config()
+	config.Scopes = []string{"admin"}
+
+	tests := []struct {
+		name        string
+		contentType string
+		want        string
+	}{
+		{"default content type", "", fiber.MIMETextPlain},
+		{"content type", fiber.MIMEApplicationJSON, fiber.MIMEApplicationJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(New(Config{
+				Config:              config,
+				UnauthorizedMessage: "Anmeldung erforderlich",
+				ForbiddenMessage:    "Zugriff verweigert",
+				ErrorMessage:        "Dienst nicht verfügbar",
+				ContentType:         tt.contentType,
+			}))
+
+			for token, message := range map[string]string{
+				"inactive": "Anmeldung erforderlich",
+				"token":    "Zugriff verweigert",
+				"down":     "Dienst nicht verfügbar",
+			} {
+				req := newRequest("/", token)
+				req.Header.Set(fiber.HeaderAccept, fiber.MIMETextHTML)
+				resp, body := respond(t, app, req)
+				if body != message {
+					t.Errorf("%s: body = %q, want %q", token, body, message)
+				}
+				if got := resp.Header.Get(fiber.HeaderContentType); got != tt.want {
+					t.Errorf("%s: Content-Type = %q, want %q", token, got, tt.want)
+				}
+			}
+		})
+	}
+}
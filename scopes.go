@@ -0,0 +1,125 @@
+package introspect
+
+import (
+	"strings"
+
+	introspection "github.com/arsmn/oauth2-introspection"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ScopesFromContext returns the scopes granted to the token stored by the
+// middleware. The result is empty, never nil, when there are none.
+// Scopes pre-parsed by the middleware are reused, so the returned slice must
+// not be modified.
+func ScopesFromContext(c *fiber.Ctx, key ...string) []string {
+	var k interface{} = scopesKey{}
+	if len(key) > 0 && key[0] != "" {
+		k = key[0] + scopesKeySuffix
+	}
+	if scopes, ok := c.Locals(k).([]string); ok {
+		return scopes
+	}
+
+	result, ok := FromContext(c, key...)
+	if !ok {
+		return []string{}
+	}
+	return parseScopes(result.Scope)
+}
+
+// HasScope reports whether the token stored by the middleware was granted
+// scope.
+func HasScope(c *fiber.Ctx, scope string) bool {
+	return exactScopeStrategy(ScopesFromContext(c), scope)
+}
+
+// RequireScopes returns a handler granting access only when the token stored
+// by the middleware has every given scope.
+// It must run after New, e.g. mount New app-wide and RequireScopes per route.
+// The ScopeStrategy, OnMissingScopes, Forbidden and Unauthorized of that
+// middleware apply, and decisions are passed to its Logger.
+func RequireScopes(scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		m, ok := c.Locals(middlewareKey{}).(*Middleware)
+		if !ok {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		return m.requireScopes(c, scopes)
+	}
+}
+
+// requireScopes is RequireScopes for a request handled by m.
+func (m *Middleware) requireScopes(c *fiber.Ctx, required []string) error {
+	result, ok := FromContext(c)
+	if !ok {
+		m.cfg.Logger(c, EventUnauthorized, ErrMissingToken)
+		return m.unauthorized(c, ErrMissingToken)
+	}
+
+	granted, ok := c.Locals(grantedScopesKey{}).([]string)
+	if !ok {
+		granted = parseScopes(result.Scope)
+	}
+	if hasScopes(granted, required, true, m.cfg.ScopeStrategy) {
+		return c.Next()
+	}
+
+	m.cfg.Logger(c, EventForbidden, introspection.ErrForbidden)
+	if m.cfg.OnMissingScopes != nil {
+		return m.cfg.OnMissingScopes(c, missingScopes(granted, required, m.cfg.ScopeStrategy))
+	}
+	return m.cfg.Forbidden(c)
+}
+
+// parseScopes splits a space-delimited scope claim, ignoring extra whitespace.
+func parseScopes(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// hasScopes reports whether granted satisfies required using strategy.
+// When all is false a single matching scope is enough.
+func hasScopes(granted, required []string, all bool, strategy func([]string, string) bool) bool {
+	if len(required) == 0 {
+		return true
+	}
+
+	if strategy == nil {
+		strategy = exactScopeStrategy
+	}
+
+	for _, scope := range required {
+		ok := strategy(granted, scope)
+		if all && !ok {
+			return false
+		}
+		if !all && ok {
+			return true
+		}
+	}
+
+	return all
+}
+
+// missingScopes returns the required scopes not satisfied by granted.
+func missingScopes(granted, required []string, strategy func([]string, string) bool) []string {
+	if strategy == nil {
+		strategy = exactScopeStrategy
+	}
+
+	var missing []string
+	for _, scope := range required {
+		if !strategy(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+func exactScopeStrategy(granted []string, scope string) bool {
+	for _, s := range granted {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
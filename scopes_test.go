@@ -0,0 +1,288 @@
+package introspect
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestParseScopes(t *testing.T) {
+	got := parseScopes("  read:orders \t write:orders\n")
+	if want := []string{"read:orders", "write:orders"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseScopes = %q, want %q", got, want)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	required := []string{"read:orders", "write:orders"}
+
+	tests := []struct {
+		name     string
+		granted  string
+		anyScope bool
+		want     int
+	}{
+		{"all granted", "write:orders read:orders", false, fiber.StatusOK},
+		{"one missing", "read:orders", false, fiber.StatusForbidden},
+		{"none granted", "", false, fiber.StatusForbidden},
+		{"any scope with one", "read:orders", true, fiber.StatusOK},
+		{"any scope with none", "read:users", true, fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{"scope": tt.granted})))
+			config := e.config()
+			config.Scopes = required
+			app := newTestApp(New(Config{Config: config, AnyScope: tt.anyScope}))
+
+			if got := send(t, app, newRequest("/", "token")); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnMissingScopes(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{"scope": "read:orders"})))
+	config := e.config()
+	config.Scopes = []string{"read:orders", "write:orders", "delete:orders"}
+
+	var missing []string
+	app := newTestApp(New(Config{
+		Config: config,
+		OnMissingScopes: func(c *fiber.Ctx, m []string) error {
+			missing = m
+			return c.SendStatus(fiber.StatusForbidden)
+		},
+	}))
+
+	if got := send(t, app, newRequest("/", "token")); got != fiber.StatusForbidden {
+		t.Errorf("status = %d, want %d", got, fiber.StatusForbidden)
+	}
+	if want := []string{"write:orders", "delete:orders"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing = %q, want %q", missing, want)
+	}
+}
+
+func TestScopesFunc(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		granted  string
+		anyScope bool
+		want     int
+		missing  []string
+	}{
+		{"granted", "/orders", "read:orders write:orders", false, fiber.StatusOK, nil},
+		{"other resource", "/users", "read:orders write:orders", false, fiber.StatusForbidden, []string{"read:users", "write:users"}},
+		{"one missing", "/orders", "read:orders", false, fiber.StatusForbidden, []string{"write:orders"}},
+		{"any scope", "/orders", "read:orders", true, fiber.StatusOK, nil},
+		{"no scopes required", "/", "", false, fiber.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{"scope": tt.granted})))
+			config := e.config()
+			config.Scopes = []string{"admin"} // ScopesFunc takes precedence.
+
+			var missing []string
+			app := newTestApp(New(Config{
+				Config:   config,
+				AnyScope: tt.anyScope,
+				ScopesFunc: func(c *fiber.Ctx) []string {
+					resource := strings.TrimPrefix(c.Path(), "/")
+					if resource == "" {
+						return nil
+					}
+					return []string{"read:" + resource, "write:" + resource}
+				},
+				OnMissingScopes: func(c *fiber.Ctx, m []string) error {
+					missing = m
+					return c.SendStatus(fiber.StatusForbidden)
+				},
+			}))
+
+			if got := send(t, app, newRequest(tt.path, "token")); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+			if !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("missing = %q, want %q", missing, tt.missing)
+			}
+		})
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(active(map[string]interface{}{"scope": r.PostForm.Get("token")}))(w, r)
+	})
+
+	config := e.config()
+	config.ScopeStrategy = func(granted []string, scope string) bool {
+		return exactScopeStrategy(granted, scope) || exactScopeStrategy(granted, "admin")
+	}
+
+	var missing []string
+	app := fiber.New()
+	app.Use(New(Config{
+		Config:           config,
+		Optional:         true,
+		ScopesContextKey: "granted",
+		Unauthorized: func(c *fiber.Ctx) error {
+			return c.SendStatus(fiber.StatusTeapot)
+		},
+		OnMissingScopes: func(c *fiber.Ctx, m []string) error {
+			missing = m
+			return c.SendStatus(fiber.StatusPaymentRequired)
+		},
+	}))
+	app.Get("/orders", RequireScopes("read:orders", "write:orders"), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	tests := []struct {
+		name    string
+		token   string
+		want    int
+		missing []string
+	}{
+		{"every scope", "read:orders write:orders", fiber.StatusOK, nil},
+		{"strategy", "admin", fiber.StatusOK, nil},
+		{"missing scope", "read:orders", fiber.StatusPaymentRequired, []string{"write:orders"}},
+		{"anonymous", "", fiber.StatusTeapot, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing = nil
+			if got := send(t, app, newRequest("/orders", tt.token)); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+			if !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("missing = %q, want %q", missing, tt.missing)
+			}
+		})
+	}
+}
+
+func TestRequireScopesWithoutMiddleware(t *testing.T) {
+	app := newTestApp(RequireScopes("read:orders"))
+
+	if got := send(t, app, newRequest("/", "token")); got != fiber.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", got, fiber.StatusUnauthorized)
+	}
+}
+
+// BenchmarkHasScope compares HasScope reusing the scopes parsed by the
+// middleware with HasScope parsing the scope claim on every call.
+func BenchmarkHasScope(b *testing.B) {
+	e := newTestEndpoint(b, respondJSON(active(map[string]interface{}{"scope": "orders:read orders:write users:read"})))
+
+	for _, bb := range []struct {
+		name   string
+		parsed bool
+	}{
+		{"parsed", true},
+		{"unparsed", false},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			var granted bool
+			app := fiber.New()
+			app.Use(New(Config{Config: e.config()}))
+			app.Get("/", func(c *fiber.Ctx) error {
+				if !bb.parsed {
+					c.Locals(scopesKey{}, nil)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					granted = HasScope(c, "users:read")
+				}
+				b.StopTimer()
+				return nil
+			})
+
+			send(b, app, newRequest("/", "token"))
+			if !granted {
+				b.Fatal("scope not granted")
+			}
+		})
+	}
+}
+
+func TestScopesFromContext(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(active(map[string]interface{}{"scope": "read write"})))
+
+	var (
+		granted, missing []string
+		has, hasOther    bool
+	)
+	app := fiber.New()
+	app.Get("/none", func(c *fiber.Ctx) error {
+		missing = ScopesFromContext(c)
+		return nil
+	})
+	app.Use(New(Config{Config: e.config()}))
+	app.Get("/", func(c *fiber.Ctx) error {
+		granted = ScopesFromContext(c)
+		has, hasOther = HasScope(c, "write"), HasScope(c, "admin")
+		return nil
+	})
+
+	send(t, app, newRequest("/", "token"))
+	if want := []string{"read", "write"}; !reflect.DeepEqual(granted, want) {
+		t.Errorf("ScopesFromContext = %q, want %q", granted, want)
+	}
+	if !has || hasOther {
+		t.Errorf("HasScope = %v for a granted scope and %v for another, want true and false", has, hasOther)
+	}
+
+	send(t, app, newRequest("/none", ""))
+	if missing == nil || len(missing) != 0 {
+		t.Errorf("ScopesFromContext without a result = %#v, want an empty slice", missing)
+	}
+}
+
+func TestScopesContextKey(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		if token := r.PostForm.Get("token"); token != "unscoped" {
+			respondJSON(active(map[string]interface{}{"scope": token}))(w, r)
+			return
+		}
+		respondJSON(active(nil))(w, r)
+	})
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		key   string
+		token string
+		want  interface{}
+	}{
+		{"default", Config{}, "user_scopes", "read write", []string{"read", "write"}},
+		{"custom context key", Config{ContextKey: "token"}, "token_scopes", "read", []string{"read"}},
+		{"custom scopes key", Config{ScopesContextKey: "scopes"}, "scopes", "read", []string{"read"}},
+		{"no scope claim", Config{}, "user_scopes", "unscoped", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Config = e.config()
+
+			var got interface{}
+			app := fiber.New()
+			app.Use(New(cfg))
+			app.Get("/", func(c *fiber.Ctx) error {
+				got = c.Locals(tt.key)
+				return nil
+			})
+
+			send(t, app, newRequest("/", tt.token))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Locals(%q) = %#v, want %#v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
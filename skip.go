@@ -0,0 +1,52 @@
+package introspect
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// skipRequest reports whether c matches SkipPaths and SkipMethods.
+func skipRequest(cfg Config, c *fiber.Ctx) bool {
+	if len(cfg.SkipPaths) == 0 && len(cfg.SkipMethods) == 0 {
+		return false
+	}
+
+	if len(cfg.SkipMethods) > 0 {
+		method := c.Method()
+		matched := false
+		for _, m := range cfg.SkipMethods {
+			if strings.EqualFold(m, method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(cfg.SkipPaths) == 0 {
+		return true
+	}
+
+	path := c.Path()
+	for _, pattern := range cfg.SkipPaths {
+		if matchPath(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath matches path against a SkipPaths entry: a pattern ending in "*"
+// matches the paths starting with the rest of it, any other pattern only
+// the exact path. Matching is case-sensitive and a trailing slash is
+// significant, whatever the routing options of the app, so that a path
+// routed like a skipped one but written differently is still introspected.
+func matchPath(pattern, path string) bool {
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == pattern
+}
@@ -0,0 +1,56 @@
+package introspect
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSkipPaths(t *testing.T) {
+	e := newTestEndpoint(t, respondJSON(map[string]interface{}{"active": false}))
+
+	tests := []struct {
+		name    string
+		paths   []string
+		methods []string
+		method  string
+		path    string
+		skipped bool
+	}{
+		{"exact", []string{"/health"}, nil, fiber.MethodGet, "/health", true},
+		{"other path", []string{"/health"}, nil, fiber.MethodGet, "/healthz", false},
+		{"parent path", []string{"/health/live"}, nil, fiber.MethodGet, "/health", false},
+		{"child path", []string{"/health"}, nil, fiber.MethodGet, "/health/live", false},
+		{"case", []string{"/health"}, nil, fiber.MethodGet, "/Health", false},
+		{"trailing slash", []string{"/health"}, nil, fiber.MethodGet, "/health/", false},
+		{"missing trailing slash", []string{"/health/"}, nil, fiber.MethodGet, "/health", false},
+		{"prefix", []string{"/public/*"}, nil, fiber.MethodGet, "/public/css/site.css", true},
+		{"prefix itself", []string{"/public/*"}, nil, fiber.MethodGet, "/public/", true},
+		{"prefix without slash", []string{"/public/*"}, nil, fiber.MethodGet, "/public", false},
+		{"near-miss prefix", []string{"/public/*"}, nil, fiber.MethodGet, "/publications", false},
+		{"prefix case", []string{"/public/*"}, nil, fiber.MethodGet, "/Public/site.css", false},
+		{"params are literal", []string{"/users/:id"}, nil, fiber.MethodGet, "/users/42", false},
+		{"literal param", []string{"/users/:id"}, nil, fiber.MethodGet, "/users/:id", true},
+		{"segment count", []string{"/a/b"}, nil, fiber.MethodGet, "/a/b/c", false},
+		{"second entry", []string{"/health", "/ready"}, nil, fiber.MethodGet, "/ready", true},
+		{"method", nil, []string{fiber.MethodOptions}, fiber.MethodOptions, "/orders", true},
+		{"method case", nil, []string{"options"}, fiber.MethodOptions, "/orders", true},
+		{"other method", nil, []string{fiber.MethodOptions}, fiber.MethodGet, "/orders", false},
+		{"path and method", []string{"/health"}, []string{fiber.MethodGet}, fiber.MethodGet, "/health", true},
+		{"path but not method", []string{"/health"}, []string{fiber.MethodGet}, fiber.MethodPost, "/health", false},
+		{"method but not path", []string{"/health"}, []string{fiber.MethodGet}, fiber.MethodGet, "/orders", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(New(Config{Config: e.config(), SkipPaths: tt.paths, SkipMethods: tt.methods}))
+			want := fiber.StatusUnauthorized
+			if tt.skipped {
+				want = fiber.StatusOK
+			}
+			if got := send(t, app, httptest.NewRequest(tt.method, tt.path, nil)); got != want {
+				t.Errorf("status = %d, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package introspect
+
+import "context"
+
+// SpanFunc starts a span around obtaining the introspection result of a
+// request and returns a function ending it. cached reports whether the
+// result came from Config.Cache. It can wrap an OpenTelemetry trace.Tracer:
+//
+//	func(ctx context.Context) (context.Context, func(bool, error)) {
+//		ctx, span := tracer.Start(ctx, "introspect")
+//		return ctx, func(cached bool, err error) {
+//			span.SetAttributes(attribute.Bool("introspect.cached", cached))
+//			if err != nil {
+//				span.RecordError(err)
+//			}
+//			span.End()
+//		}
+//	}
+type SpanFunc func(ctx context.Context) (context.Context, func(cached bool, err error))
+
+func nopSpan(ctx context.Context) (context.Context, func(bool, error)) {
+	return ctx, func(bool, error) {}
+}
@@ -0,0 +1,65 @@
+package introspect
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+type spanKey struct{}
+
+func TestStartSpan(t *testing.T) {
+	e := newTestEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.PostForm.Get("token") == "down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		respondJSON(active(nil))(w, r)
+	})
+
+	type span struct {
+		cached bool
+		err    error
+	}
+	var (
+		spans   []span
+		started int
+		traced  int
+	)
+	app := newTestApp(New(Config{
+		Config: e.config(),
+		Cache:  NewMemoryCache(0),
+		HTTPClient: &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Context().Value(spanKey{}) != nil {
+				traced++
+			}
+			return http.DefaultTransport.RoundTrip(r)
+		})},
+		StartSpan: func(ctx context.Context) (context.Context, func(bool, error)) {
+			started++
+			return context.WithValue(ctx, spanKey{}, true), func(cached bool, err error) {
+				spans = append(spans, span{cached, err})
+			}
+		},
+	}))
+
+	for _, token := range []string{"token", "token", "down"} {
+		send(t, app, newRequest("/", token))
+	}
+
+	if started != 3 || len(spans) != 3 {
+		t.Fatalf("%d spans started and %d ended, want 3", started, len(spans))
+	}
+	if spans[0].cached || spans[0].err != nil {
+		t.Errorf("introspected: span = %+v, want not cached without error", spans[0])
+	}
+	if !spans[1].cached || spans[1].err != nil {
+		t.Errorf("cached: span = %+v, want cached without error", spans[1])
+	}
+	if spans[2].cached || spans[2].err == nil {
+		t.Errorf("failed: span = %+v, want the introspection error", spans[2])
+	}
+	if traced != 2 {
+		t.Errorf("%d introspections got the span context, want 2", traced)
+	}
+}